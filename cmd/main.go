@@ -14,6 +14,7 @@ import (
 	"github.com/number571/go-peer/encoding"
 	"github.com/number571/union-bc/kernel"
 	"github.com/number571/union-bc/network"
+	"github.com/number571/union-bc/protocol"
 )
 
 var (
@@ -43,6 +44,11 @@ func init() {
 		Chain = kernel.NewChain(ChainPath, newGenesis())
 	}
 
+	if Chain == nil {
+		Log().Error("LOAD", 0, 0, kernel.TXsSize, 0)
+		os.Exit(1)
+	}
+
 	if len(os.Args) >= 3 && os.Args[2] == "rollback" {
 		defaultNum := 10
 		if len(os.Args) == 4 {
@@ -54,7 +60,7 @@ func init() {
 }
 
 func main() {
-	node := network.NewNode().
+	node := network.NewNode(Address).
 		Handle(MsgGetTime, handleGetTime).
 		Handle(MsgGetHeight, handleGetHeight).
 		Handle(MsgGetBlock, handleGetBlock).
@@ -71,9 +77,9 @@ func initClient() {
 
 	for i := 0; i < ClientsNum; i++ {
 		go func() {
-			conn := network.NewConn(Address)
-			if conn == nil {
-				panic("conn is nil")
+			conn, err := network.NewClient(Address)
+			if err != nil {
+				panic(err)
 			}
 			defer conn.Close()
 
@@ -93,21 +99,29 @@ func initClient() {
 
 func initNode(node network.Node) {
 	fmt.Println("Node is listening...")
-	var conn network.Conn
+	var conn network.Client
 
 	for _, addr := range ListAddr {
 		if addr == Address {
 			continue
 		}
-		conn = network.NewConn(addr)
-		if conn == nil {
+		client, err := network.NewClient(addr)
+		if err != nil {
+			continue
+		}
+
+		// blocks accepted from failed peer are kept,
+		// next peer continues from them
+		if !syncBlocks(client) {
+			client.Close()
 			continue
 		}
+
+		conn = client
 		break
 	}
 
 	if conn != nil {
-		syncBlocks(conn)
 		atomic.StoreUint64(&CurrentTime, getTime(conn))
 		conn.Close()
 	}
@@ -135,7 +149,7 @@ func initNode(node network.Node) {
 			}
 
 			commitBlock(node, Chain.Mempool(), Chain.Height())
-			tryUpdateBlock(node, Chain.Mempool(), Chain.Height())
+			tryUpdateBlock(node, Chain.Mempool())
 		}
 	}(node)
 }
@@ -146,10 +160,14 @@ func commitBlock(node network.Node, mempool kernel.Mempool, height kernel.Height
 		block kernel.Block
 	}
 
+	commitBlock := Chain.Block(height)
+	if commitBlock == nil {
+		return
+	}
+
 	var (
-		commitBlock = Chain.Block(height)
-		hash        = encoding.Base64Encode(commitBlock.Hash())
-		blocks      = make(map[string]blockInfo)
+		hash   = encoding.Base64Encode(commitBlock.Hash())
+		blocks = make(map[string]blockInfo)
 	)
 
 	blocks[hash] = blockInfo{
@@ -162,8 +180,8 @@ func commitBlock(node network.Node, mempool kernel.Mempool, height kernel.Height
 			continue
 		}
 
-		conn := network.NewConn(addr)
-		if conn == nil {
+		conn, err := network.NewClient(addr)
+		if err != nil {
 			continue
 		}
 
@@ -219,9 +237,11 @@ func commitBlock(node network.Node, mempool kernel.Mempool, height kernel.Height
 
 	commitBlock = listBlocks[0].block
 
+	// chain is changed only under mutex of node
 	node.Mutex().Lock()
+	defer node.Mutex().Unlock()
+
 	ok := Chain.Rollback(1)
-	node.Mutex().Unlock()
 	if !ok {
 		Log().Warning("COMMIT", height, commitBlock.Hash(), mempool.Height(), kernel.TXsSize, len(node.Connections()))
 		return
@@ -236,7 +256,7 @@ func commitBlock(node network.Node, mempool kernel.Mempool, height kernel.Height
 	Log().Info("COMMIT", height, commitBlock.Hash(), mempool.Height(), kernel.TXsSize, len(node.Connections()))
 }
 
-func getBlock(conn network.Conn, height kernel.Height) kernel.Block {
+func getBlock(conn network.Client, height kernel.Height) kernel.Block {
 	msg := network.NewMessage(
 		MsgGetBlock,
 		encoding.Uint64ToBytes(uint64(height)),
@@ -250,7 +270,7 @@ func getBlock(conn network.Conn, height kernel.Height) kernel.Block {
 	return kernel.LoadBlock(msg.Body())
 }
 
-func getTime(conn network.Conn) uint64 {
+func getTime(conn network.Client) uint64 {
 	msg := network.NewMessage(
 		MsgGetTime,
 		nil,
@@ -264,41 +284,49 @@ func getTime(conn network.Conn) uint64 {
 	return encoding.BytesToUint64(msg.Body())
 }
 
-func syncBlocks(conn network.Conn) {
-	var (
-		mempool    = Chain.Mempool()
-		initHeight = Chain.Height()
-	)
-
-	i := initHeight
-
-	// syncable all blocks
-	for ; ; i++ {
-		if i == initHeight && initHeight != 0 {
-			continue
+// Genesis of new node is replaced by genesis of peer,
+// then blocks are downloaded from peer. Returns false
+// if peer failed, node exits if its chain is not of peer.
+func syncBlocks(conn network.Client) bool {
+	if Chain.Height() == 0 {
+		genesis, err := protocol.GetBlock(conn, 0)
+		if err != nil {
+			return false
 		}
 
-		block := getBlock(conn, i)
-		if block == nil {
-			break
+		Chain.Close()
+		Chain = kernel.NewChain(ChainPath, genesis)
+		if Chain == nil {
+			Log().Error("SYNCABLE", 0, 0, kernel.TXsSize, 0)
+			os.Exit(1)
 		}
+		Log().Warning("SYNCABLE", 0, genesis.Hash(), Chain.Mempool().Height(), kernel.TXsSize, 0)
+	}
 
-		if i == 0 {
-			Chain.Close()
-			Chain = kernel.NewChain(ChainPath, block)
-			mempool = Chain.Mempool()
-			Log().Warning("SYNCABLE", i, block.Hash(), mempool.Height(), kernel.TXsSize, 0)
-		}
+	synced := true
+	switch protocol.SyncFrom(Chain, conn) {
+	case nil:
+	case protocol.ErrOtherChain, protocol.ErrBlockRejected:
+		Log().Error("SYNCABLE", Chain.Height(), Chain.Mempool().Height(), kernel.TXsSize, 0)
+		os.Exit(1)
+	default:
+		// peer did not respond or sent invalid block
+		synced = false
+	}
 
-		if i != 0 {
-			ok := Chain.Accept(block)
-			if !ok {
-				Log().Error("SYNCABLE", i, mempool.Height(), kernel.TXsSize, 0)
-				os.Exit(1)
-			}
-			Log().Info("SYNCABLE", i, block.Hash(), mempool.Height(), kernel.TXsSize, 0)
-		}
+	tip, err := Chain.Tip()
+	if err != nil {
+		Log().Error("SYNCABLE", Chain.Height(), Chain.Mempool().Height(), kernel.TXsSize, 0)
+		os.Exit(1)
+	}
+
+	if !synced {
+		Log().Warning("SYNCABLE", Chain.Height(), tip.Hash(), Chain.Mempool().Height(), kernel.TXsSize, 0)
+		return false
 	}
+
+	Log().Info("SYNCABLE", Chain.Height(), tip.Hash(), Chain.Mempool().Height(), kernel.TXsSize, 0)
+	return true
 }
 
 func handleGetTime(node network.Node, conn network.Conn, msg network.Message) {
@@ -306,7 +334,8 @@ func handleGetTime(node network.Node, conn network.Conn, msg network.Message) {
 		currTime = atomic.LoadUint64(&CurrentTime)
 	)
 
-	rmsg := network.NewMessage(
+	rmsg := network.NewResponse(
+		msg,
 		MsgGetTime|MaskBit,
 		encoding.Uint64ToBytes(currTime),
 	)
@@ -315,46 +344,28 @@ func handleGetTime(node network.Node, conn network.Conn, msg network.Message) {
 }
 
 func handleGetHeight(node network.Node, conn network.Conn, msg network.Message) {
-	var (
-		height = uint64(Chain.Height())
-	)
-
-	rmsg := network.NewMessage(
-		MsgGetHeight|MaskBit,
-		encoding.Uint64ToBytes(height),
-	)
-
-	conn.Write(rmsg)
+	protocol.HandleGetHeight(Chain)(node, conn, msg)
 }
 
 func handleGetBlock(node network.Node, conn network.Conn, msg network.Message) {
-	var (
-		height     = kernel.Height(encoding.BytesToUint64(msg.Body()))
-		block      = Chain.Block(height)
-		blockBytes = []byte{}
-	)
-
-	if block != nil {
-		blockBytes = block.Bytes()
-	}
-
-	rmsg := network.NewMessage(
-		MsgGetBlock|MaskBit,
-		blockBytes,
-	)
-
-	conn.Write(rmsg)
+	protocol.HandleGetBlock(Chain)(node, conn, msg)
 }
 
 func handleSetBlock(node network.Node, conn network.Conn, msg network.Message) {
+	// handlers are called under mutex of node,
+	// so height is of the last block
 	var (
-		mempool   = Chain.Mempool()
-		height    = Chain.Height()
-		currBlock = Chain.Block(height)
+		mempool = Chain.Mempool()
+		height  = Chain.Height()
 	)
 
+	currBlock, err := Chain.Tip()
+	if err != nil {
+		return
+	}
+
 	upBlock := updateBlock{}
-	err := json.Unmarshal(msg.Body(), &upBlock)
+	err = json.Unmarshal(msg.Body(), &upBlock)
 	if err != nil {
 		return
 	}
@@ -372,7 +383,7 @@ func handleSetBlock(node network.Node, conn network.Conn, msg network.Message) {
 			mempool.Push(tx)
 		}
 
-		node.Broadcast(msg)
+		node.BroadcastExcept(conn, msg)
 		return
 	}
 
@@ -412,7 +423,8 @@ func handleGetTX(node network.Node, conn network.Conn, msg network.Message) {
 		txBytes = tx.Bytes()
 	}
 
-	rmsg := network.NewMessage(
+	rmsg := network.NewResponse(
+		msg,
 		MsgGetTX|MaskBit,
 		txBytes,
 	)
@@ -424,16 +436,16 @@ func handleSetTX(node network.Node, conn network.Conn, msg network.Message) {
 	var (
 		mempool = Chain.Mempool()
 		tx      = kernel.LoadTransaction(msg.Body())
-		hash    = tx.Hash()
 		retCode = uint64(0)
 	)
 
 	defer func(conn network.Conn) {
-		msg := network.NewMessage(
+		rmsg := network.NewResponse(
+			msg,
 			MsgSetTX|MaskBit,
 			encoding.Uint64ToBytes(retCode),
 		)
-		conn.Write(msg)
+		conn.Write(rmsg)
 	}(conn)
 
 	if tx == nil {
@@ -441,6 +453,8 @@ func handleSetTX(node network.Node, conn network.Conn, msg network.Message) {
 		return
 	}
 
+	hash := tx.Hash()
+
 	txInChain := Chain.TX(hash)
 	if txInChain != nil {
 		retCode = 3
@@ -453,20 +467,29 @@ func handleSetTX(node network.Node, conn network.Conn, msg network.Message) {
 		return
 	}
 
-	mempool.Push(tx)
+	if !mempool.Push(tx) {
+		retCode = 5
+		return
+	}
 }
 
-func tryUpdateBlock(node network.Node, mempool kernel.Mempool, height kernel.Height) {
+func tryUpdateBlock(node network.Node, mempool kernel.Mempool) {
 	node.Mutex().Lock()
 	defer node.Mutex().Unlock()
 
+	height := Chain.Height()
+
+	lastBlock, err := Chain.Tip()
+	if err != nil {
+		Log().Error("ACCEPT", height, mempool.Height(), kernel.TXsSize, len(node.Connections()))
+		return
+	}
+
 	txs := mempool.Pop()
 	if txs == nil {
 		return
 	}
 
-	lastBlock := Chain.Block(height)
-
 	newBlock := kernel.NewBlock(lastBlock.Hash(), txs)
 	newHeight := height + 1
 
@@ -507,7 +530,7 @@ func newGenesis() kernel.Block {
 		txs = append(txs, kernel.NewTransaction(priv, data))
 	}
 	return kernel.NewBlock(
-		[]byte("genesis.block"),
+		[]byte(kernel.ChainID),
 		txs,
 	)
 }
@@ -1,16 +1,18 @@
 package main
 
+import "github.com/number571/union-bc/protocol"
+
 const (
 	MsgGetTime   = 0x01
-	MsgGetHeight = 0x02
-	MsgGetBlock  = 0x03
+	MsgGetHeight = protocol.MsgGetHeight
+	MsgGetBlock  = protocol.MsgGetBlock
 	MsgSetBlock  = 0x04
 	MsgGetTX     = 0x05
 	MsgSetTX     = 0x06
 )
 
 const (
-	MaskBit      = (1 << 31)
+	MaskBit      = protocol.MaskBit
 	IntervalTime = 5 // seconds
 	ClientsNum   = 3
 	TXsInSecond  = 3
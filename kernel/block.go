@@ -14,12 +14,14 @@ var (
 )
 
 type BlockT struct {
+	version  uint8
 	txs      []Transaction
 	prevHash []byte
 	currHash []byte
 }
 
 type blockJSON struct {
+	Version  uint8    `json:"version"`
 	TXs      [][]byte `json:"txs"`
 	PrevHash []byte   `json:"prev_hash"`
 	CurrHash []byte   `json:"curr_hash"`
@@ -50,6 +52,7 @@ func NewBlock(prevHash []byte, txs []Transaction) Block {
 	}
 
 	block := &BlockT{
+		version:  BlockVersion,
 		txs:      txs,
 		prevHash: prevHash,
 	}
@@ -59,33 +62,57 @@ func NewBlock(prevHash []byte, txs []Transaction) Block {
 }
 
 func LoadBlock(blockBytes []byte) Block {
+	block, err := decodeBlock(blockBytes)
+	if err != nil {
+		return nil
+	}
+
+	for _, tx := range block.txs {
+		if !tx.IsValid() {
+			return nil
+		}
+	}
+
+	if !block.IsValid() {
+		return nil
+	}
+
+	return block
+}
+
+// Block and its transactions are not validated.
+// Blocks serialized before versioning are of first version.
+func decodeBlock(blockBytes []byte) (*BlockT, error) {
 	blockConv := new(blockJSON)
 	err := json.Unmarshal(blockBytes, blockConv)
 	if err != nil {
-		return nil
+		return nil, ErrBlockDecode
+	}
+
+	version := blockConv.Version
+	if version == 0 {
+		version = BlockVersionMin
+	}
+
+	if version > BlockVersion {
+		return nil, ErrBlockVersion
 	}
 
 	block := &BlockT{
+		version:  version,
 		prevHash: blockConv.PrevHash,
 		currHash: blockConv.CurrHash,
 	}
 
 	for _, tx := range blockConv.TXs {
-		loadTx := LoadTransaction(tx)
-		if loadTx == nil {
-			return nil
+		decTx := decodeTransaction(tx)
+		if decTx == nil {
+			return nil, ErrTXDecode
 		}
-		if !loadTx.IsValid() {
-			return nil
-		}
-		block.txs = append(block.txs, loadTx)
-	}
-
-	if !block.IsValid() {
-		return nil
+		block.txs = append(block.txs, decTx)
 	}
 
-	return block
+	return block, nil
 }
 
 func (block *BlockT) Transactions() []Transaction {
@@ -98,6 +125,7 @@ func (block *BlockT) PrevHash() Hash {
 
 func (block *BlockT) Bytes() []byte {
 	blockConv := &blockJSON{
+		Version:  block.version,
 		PrevHash: block.PrevHash(),
 		CurrHash: block.Hash(),
 	}
@@ -127,20 +155,59 @@ func (block *BlockT) IsValid() bool {
 		return false
 	}
 
-	sort.SliceStable(block.txs, func(i, j int) bool {
-		return bytes.Compare(block.txs[i].Hash(), block.txs[j].Hash()) < 0
-	})
+	// transactions must be sorted by hash without duplicates
+	for i := 0; i < len(block.txs)-1; i++ {
+		if bytes.Compare(block.txs[i].Hash(), block.txs[i+1].Hash()) >= 0 {
+			return false
+		}
+	}
 
 	return bytes.Equal(block.Hash(), block.newHash())
 }
 
+// Root of hash tree over transactions in block order.
+func (block *BlockT) MerkleRoot() Hash {
+	return MerkleRoot(block.txHashes())
+}
+
+// Proof of transaction inclusion and its index in block.
+// Returns nil proof and negative index if not found.
+func (block *BlockT) MerkleProof(hash Hash) ([]Hash, int) {
+	hashes := block.txHashes()
+	for i := range hashes {
+		if bytes.Equal(hashes[i], hash) {
+			return merkleProof(hashes, i), i
+		}
+	}
+	return nil, -1
+}
+
+func (block *BlockT) txHashes() []Hash {
+	hashes := make([]Hash, 0, len(block.txs))
+	for _, tx := range block.txs {
+		hashes = append(hashes, tx.Hash())
+	}
+	return hashes
+}
+
+// Blocks of first version hash transactions in chain
+// and do not commit to merkle root.
 func (block *BlockT) newHash() Hash {
-	hash := bytes.Join(
+	if block.version == BlockVersionMin {
+		return block.chainHash()
+	}
+
+	return crypto.NewSHA256(bytes.Join(
 		[][]byte{
 			block.PrevHash(),
+			block.MerkleRoot(),
 		},
 		[]byte{},
-	)
+	)).Bytes()
+}
+
+func (block *BlockT) chainHash() Hash {
+	hash := block.PrevHash()
 
 	for _, tx := range block.txs {
 		hash = crypto.NewSHA256(bytes.Join(
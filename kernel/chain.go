@@ -2,8 +2,10 @@ package kernel
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"sync"
 
@@ -14,12 +16,34 @@ var (
 	_ Chain = &ChainT{}
 )
 
+var (
+	ErrBlockNotFound = errors.New("chain: block not found")
+	ErrBlockDecode   = errors.New("chain: block can not be decoded")
+	ErrBlockVersion  = errors.New("chain: block is of unknown version")
+	ErrBlockInvalid  = errors.New("chain: block is invalid")
+	ErrBlockLink     = errors.New("chain: block is not linked to parent")
+	ErrCheckpoint    = errors.New("chain: block does not match checkpoint")
+	ErrGenesis       = errors.New("chain: genesis is not of chain id")
+	ErrTXDecode      = errors.New("chain: transaction can not be decoded")
+	ErrTXInvalid     = errors.New("chain: transaction is invalid")
+)
+
+var (
+	errRewritten = errors.New("chain: blocks replaced during verify")
+)
+
 type ChainT struct {
-	mtx     sync.Mutex
-	path    string
-	blocks  KeyValueDB
-	txs     KeyValueDB
-	mempool Mempool
+	mtx         sync.RWMutex
+	blocks      KeyValueDB
+	txs         KeyValueDB
+	mempool     Mempool
+	checkpoints map[Height]Hash
+	logger      Logger
+	rewrites    uint64
+
+	subsMtx sync.Mutex
+	subsID  uint64
+	subs    map[uint64]chan Block
 }
 
 func NewChain(path string, genesis Block) Chain {
@@ -29,7 +53,7 @@ func NewChain(path string, genesis Block) Chain {
 		mempoolPath = filepath.Join(path, MempoolPath)
 	)
 
-	if !genesis.IsValid() {
+	if !isGenesis(genesis) {
 		return nil
 	}
 
@@ -52,15 +76,18 @@ func NewChain(path string, genesis Block) Chain {
 		return nil
 	}
 
-	chain := &ChainT{
-		path:   path,
-		blocks: blocks,
-		txs:    txs,
-		mempool: &MempoolT{
-			ptr: mempool,
-		},
+	return NewChainWithDB(blocks, txs, mempool, genesis)
+}
+
+// Create chain over any storage backend.
+// Databases must be empty.
+func NewChainWithDB(blocks, txs, mempool KeyValueDB, genesis Block) Chain {
+	if !isGenesis(genesis) {
+		return nil
 	}
 
+	chain := loadChain(blocks, txs, mempool)
+
 	chain.setHeight(0)
 	chain.setBlock(genesis)
 	mempool.Set(GetKeyMempoolHeight(), encoding.Uint64ToBytes(0))
@@ -90,21 +117,49 @@ func LoadChain(path string) Chain {
 		return nil
 	}
 
+	return LoadChainWithDB(blocks, txs, mempool)
+}
+
+// Load chain from any storage backend.
+// Returns nil and closes databases
+// if stored genesis is not of ChainID.
+func LoadChainWithDB(blocks, txs, mempool KeyValueDB) Chain {
+	chain := loadChain(blocks, txs, mempool)
+	if chain.getPruned() == 0 && !isGenesis(chain.getBlock(0)) {
+		chain.Close()
+		return nil
+	}
+	return chain
+}
+
+func loadChain(blocks, txs, mempool KeyValueDB) *ChainT {
 	return &ChainT{
-		path:   path,
 		blocks: blocks,
 		txs:    txs,
 		mempool: &MempoolT{
 			ptr: mempool,
 		},
+		checkpoints: make(map[Height]Hash),
+		logger:      &nopLoggerT{},
+		subs:        make(map[uint64]chan Block),
 	}
 }
 
 func (chain *ChainT) Close() {
+	chain.subsMtx.Lock()
+	for id, ch := range chain.subs {
+		delete(chain.subs, id)
+		close(ch)
+	}
+	chain.subsMtx.Unlock()
+
 	chain.blocks.Close()
 	chain.txs.Close()
 
-	mempool := chain.mempool.(*MempoolT)
+	mempool, ok := chain.mempool.(*MempoolT)
+	if !ok {
+		return
+	}
 	mempool.ptr.Close()
 }
 
@@ -114,21 +169,83 @@ func (chain *ChainT) Rollback(ptr uint64) bool {
 
 	hptr := Height(ptr)
 
-	if hptr > chain.Height() {
+	if hptr > chain.getHeight() {
 		return false
 	}
 
-	oldHeight := chain.Height()
+	oldHeight := chain.getHeight()
 	newHeight := oldHeight - hptr
 
+	if newHeight < chain.getPruned() {
+		return false
+	}
+
+	for height := range chain.checkpoints {
+		if newHeight < height && height <= oldHeight {
+			return false
+		}
+	}
+
 	chain.setHeight(newHeight)
 	for i := newHeight + 1; i <= oldHeight; i++ {
 		chain.delBlock(i)
 	}
+	chain.rewrites++
+
+	chain.logger.Info("chain rolled back", "from", oldHeight, "to", newHeight)
+	return true
+}
+
+// Delete blocks below height, keeping their hashes
+// and transactions, so pruned part is still indexed.
+// Last block can not be pruned.
+func (chain *ChainT) Prune(keepFrom Height) bool {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if keepFrom > chain.getHeight() {
+		return false
+	}
+
+	pruned := chain.getPruned()
+	if keepFrom <= pruned {
+		return true
+	}
 
+	for i := pruned; i < keepFrom; i++ {
+		chain.blocks.Del(GetKeyBlock(i))
+	}
+	chain.setPruned(keepFrom)
+	chain.rewrites++
+
+	chain.logger.Info("chain pruned", "from", pruned, "to", keepFrom)
 	return true
 }
 
+// Set known-good block hashes by heights.
+// Blocks at these heights must match and can not be rolled back.
+func (chain *ChainT) SetCheckpoints(checkpoints map[Height]Hash) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	chain.checkpoints = make(map[Height]Hash)
+	for height, hash := range checkpoints {
+		chain.checkpoints[height] = hash
+	}
+}
+
+// Set logger of chain changes and rejected blocks.
+// Nothing is logged if nil.
+func (chain *ChainT) SetLogger(logger Logger) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if logger == nil {
+		logger = &nopLoggerT{}
+	}
+	chain.logger = logger
+}
+
 func (chain *ChainT) Mempool() Mempool {
 	return chain.mempool
 }
@@ -142,16 +259,33 @@ func (chain *ChainT) Accept(block Block) bool {
 	}
 
 	if !block.IsValid() {
+		chain.logger.Debug("block rejected", "reason", ErrBlockInvalid)
+		return false
+	}
+
+	lastBlock := chain.getBlock(chain.getHeight())
+	if lastBlock == nil {
 		return false
 	}
 
-	lastBlock := chain.Block(chain.Height())
 	if !bytes.Equal(lastBlock.Hash(), block.PrevHash()) {
+		chain.logger.Debug("block rejected", "reason", ErrBlockLink)
 		return false
 	}
 
+	if !chain.inCheckpoint(chain.getHeight()+1, block) {
+		chain.logger.Warn("block rejected", "reason", ErrCheckpoint)
+		return false
+	}
+
+	var hashes []Hash
 	for _, tx := range block.Transactions() {
-		if chain.TX(tx.Hash()) != nil {
+		hashes = append(hashes, tx.Hash())
+	}
+
+	for _, ok := range chain.hasTXs(hashes) {
+		if ok {
+			chain.logger.Debug("block rejected", "reason", "transaction already in chain")
 			return false
 		}
 	}
@@ -161,24 +295,174 @@ func (chain *ChainT) Accept(block Block) bool {
 		mempool.Delete(tx.Hash())
 	}
 
-	chain.setHeight(chain.Height() + 1)
+	chain.setHeight(chain.getHeight() + 1)
 	chain.setBlock(block)
+	chain.notify(block)
 
+	chain.logger.Info("block accepted", "height", chain.getHeight(), "hash", block.Hash())
 	return true
 }
 
-func (chain *ChainT) Merge(height Height, txs []Transaction) bool {
+// Replace blocks after common ancestor with branch.
+// Branch must link to block of chain and be longer than
+// blocks it replaces. Transactions of replaced blocks
+// not included in branch are returned to mempool.
+func (chain *ChainT) TryReorg(branch []Block) bool {
 	chain.mtx.Lock()
 	defer chain.mtx.Unlock()
 
+	if len(branch) == 0 || branch[0] == nil {
+		return false
+	}
+
+	ancestor, ok := chain.getHeightByHash(branch[0].PrevHash())
+	if !ok || ancestor < chain.getPruned() {
+		return false
+	}
+
+	oldHeight := chain.getHeight()
+	newHeight := ancestor + Height(len(branch))
+	if newHeight <= oldHeight {
+		return false
+	}
+
+	// transactions of replaced blocks can be in branch
+	replaced := make(map[string]Transaction)
+	for i := ancestor + 1; i <= oldHeight; i++ {
+		block := chain.getBlock(i)
+		if block == nil {
+			return false
+		}
+		for _, tx := range block.Transactions() {
+			replaced[string(tx.Hash())] = tx
+		}
+	}
+
+	var (
+		prevHash = branch[0].PrevHash()
+		included = make(map[string]bool)
+	)
+
+	for i, block := range branch {
+		if block == nil || !block.IsValid() {
+			return false
+		}
+
+		if !bytes.Equal(block.PrevHash(), prevHash) {
+			return false
+		}
+		prevHash = block.Hash()
+
+		if !chain.inCheckpoint(ancestor+Height(i)+1, block) {
+			return false
+		}
+
+		for _, tx := range block.Transactions() {
+			hash := tx.Hash()
+			if included[string(hash)] {
+				return false
+			}
+			included[string(hash)] = true
+
+			_, inReplaced := replaced[string(hash)]
+			if !inReplaced && chain.getTX(hash) != nil {
+				return false
+			}
+		}
+	}
+
+	for i := oldHeight; i > ancestor; i-- {
+		chain.delBlock(i)
+	}
+	chain.rewrites++
+
+	mempool := chain.Mempool()
+	for i, block := range branch {
+		chain.setHeight(ancestor + Height(i) + 1)
+		chain.setBlock(block)
+		chain.notify(block)
+
+		for _, tx := range block.Transactions() {
+			mempool.Delete(tx.Hash())
+		}
+	}
+
+	for hash, tx := range replaced {
+		if !included[hash] {
+			mempool.Push(tx)
+		}
+	}
+
+	chain.logger.Info("chain reorganized", "ancestor", ancestor, "from", oldHeight, "to", newHeight)
+	return true
+}
+
+// Get channel receiving every block set as last,
+// including merged and reorganized ones. Blocks are
+// dropped if subscriber does not read them in time.
+// Function cancels subscription and closes channel.
+func (chain *ChainT) Subscribe() (<-chan Block, func()) {
+	chain.subsMtx.Lock()
+	defer chain.subsMtx.Unlock()
+
+	chain.subsID++
+
 	var (
-		lastBlock = chain.Block(height)
-		resultTXs []Transaction
+		id = chain.subsID
+		ch = make(chan Block, SubsSize)
 	)
+	chain.subs[id] = ch
+
+	cancel := func() {
+		chain.subsMtx.Lock()
+		defer chain.subsMtx.Unlock()
+
+		if _, ok := chain.subs[id]; !ok {
+			return
+		}
+		delete(chain.subs, id)
+		close(ch)
+	}
+
+	return ch, cancel
+}
+
+func (chain *ChainT) notify(block Block) {
+	chain.subsMtx.Lock()
+	defer chain.subsMtx.Unlock()
+
+	for _, ch := range chain.subs {
+		select {
+		case ch <- block:
+		default:
+		}
+	}
+}
 
-	if chain.Height() != height {
+// Load serialized block and accept it.
+// Returns false if bytes are not a valid block.
+func (chain *ChainT) AcceptBytes(blockBytes []byte) bool {
+	block := LoadBlock(blockBytes)
+	if block == nil {
 		return false
 	}
+	return chain.Accept(block)
+}
+
+func (chain *ChainT) Merge(height Height, txs []Transaction) bool {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+
+	if chain.getHeight() != height {
+		return false
+	}
+
+	lastBlock := chain.getBlock(height)
+	if lastBlock == nil {
+		return false
+	}
+
+	var resultTXs []Transaction
 
 	resultTXs = append(resultTXs, lastBlock.Transactions()...)
 
@@ -187,7 +471,7 @@ func (chain *ChainT) Merge(height Height, txs []Transaction) bool {
 			return false
 		}
 
-		if chain.TX(tx.Hash()) != nil {
+		if chain.getTX(tx.Hash()) != nil {
 			continue
 		}
 
@@ -205,19 +489,274 @@ func (chain *ChainT) Merge(height Height, txs []Transaction) bool {
 	appendTXs := resultTXs[:TXsSize]
 	deleteTXs := resultTXs[TXsSize:]
 
-	chain.updateBlock(height, NewBlock(lastBlock.PrevHash(), appendTXs), deleteTXs)
+	newBlock := NewBlock(lastBlock.PrevHash(), appendTXs)
+	if !chain.inCheckpoint(height, newBlock) {
+		return false
+	}
+
+	chain.updateBlock(height, newBlock, deleteTXs)
+	chain.notify(newBlock)
+
+	chain.logger.Info("block merged", "height", height, "hash", newBlock.Hash())
 	return true
 }
 
 func (chain *ChainT) Height() Height {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
 	return chain.getHeight()
 }
 
+// Last block of the chain.
+// Returns error if chain has no blocks
+// or last block can not be loaded.
+func (chain *ChainT) Tip() (Block, error) {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	if chain.blocks.Get(GetKeyHeight()) == nil {
+		return nil, ErrBlockNotFound
+	}
+
+	block := chain.getBlock(chain.getHeight())
+	if block == nil {
+		return nil, ErrBlockNotFound
+	}
+
+	return block, nil
+}
+
+// Parent block found by previous hash in any height of chain.
+// Returns false if parent is unknown (orphan).
+// Returns true with nil block if parent is pruned.
+func (chain *ChainT) ParentOf(block Block) (Height, Block, bool) {
+	return chain.BlockByHash(block.PrevHash())
+}
+
+func (chain *ChainT) IsValid() bool {
+	_, err := chain.Verify()
+	return err == nil
+}
+
+// Check every retained block and links between blocks.
+// Returns height of first invalid block with reason,
+// or height of last block if chain is valid.
+// Blocks are loaded in batches and checked by workers
+// in parallel, links and checkpoints are checked
+// sequentially. Lock is held only while batch is loaded,
+// check is started again if blocks were replaced.
+// Last retry holds lock for the whole check.
+func (chain *ChainT) Verify() (Height, error) {
+	var (
+		height Height
+		err    error
+	)
+
+	for i := 0; i < VerifyRetry; i++ {
+		height, err = chain.verify(false)
+		if err != errRewritten {
+			break
+		}
+	}
+
+	if err == errRewritten {
+		chain.mtx.RLock()
+		height, err = chain.verify(true)
+		chain.mtx.RUnlock()
+	}
+
+	if err != nil {
+		chain.logger.Warn("chain is invalid", "height", height, "error", err)
+	}
+	return height, err
+}
+
+func (chain *ChainT) verify(locked bool) (Height, error) {
+	rlock, runlock := chain.mtx.RLock, chain.mtx.RUnlock
+	if locked {
+		// lock is held by caller
+		rlock, runlock = func() {}, func() {}
+	}
+
+	rlock()
+	var (
+		pruned   = chain.getPruned()
+		height   = chain.getHeight()
+		rewrites = chain.rewrites
+	)
+	runlock()
+
+	var last Block
+
+	for from := pruned; from <= height; from += VerifySize {
+		to := from + VerifySize - 1
+		if to > height {
+			to = height
+		}
+
+		rlock()
+		if chain.rewrites != rewrites {
+			runlock()
+			return 0, errRewritten
+		}
+		var (
+			blocks, loadErr = chain.loadBlocks(from, to)
+			checkpoints     = chain.checkpoints
+			linked          = from != pruned || chain.isFirst(pruned, blocks)
+		)
+		runlock()
+
+		errs := verifyBlocks(blocks)
+
+		for i, block := range blocks {
+			current := from + Height(i)
+
+			if errs[i] != nil {
+				return current, errs[i]
+			}
+
+			if hash, ok := checkpoints[current]; ok && !bytes.Equal(hash, block.Hash()) {
+				return current, ErrCheckpoint
+			}
+
+			if last != nil && !bytes.Equal(block.PrevHash(), last.Hash()) {
+				return current, ErrBlockLink
+			}
+
+			if last == nil && !linked {
+				if pruned == 0 {
+					return 0, ErrGenesis
+				}
+				return pruned, ErrBlockLink
+			}
+			last = block
+		}
+
+		if loadErr != nil {
+			return from + Height(len(blocks)), loadErr
+		}
+	}
+
+	return height, nil
+}
+
+// First retained block links to ChainID if chain
+// is not pruned, or to last pruned block by index.
+func (chain *ChainT) isFirst(pruned Height, blocks []Block) bool {
+	if len(blocks) == 0 {
+		return false
+	}
+
+	if pruned == 0 {
+		return bytes.Equal(blocks[0].PrevHash(), []byte(ChainID))
+	}
+
+	parent, ok := chain.getHeightByHash(blocks[0].PrevHash())
+	return ok && parent == pruned-1
+}
+
+// Blocks are decoded without validation,
+// so it is done only by workers. Loading stops
+// at first block which can not be decoded.
+func (chain *ChainT) loadBlocks(from, to Height) ([]Block, error) {
+	blocks := make([]Block, 0, to-from+1)
+
+	for i := from; i <= to; i++ {
+		data := chain.blocks.Get(GetKeyBlock(i))
+		if data == nil {
+			return blocks, ErrBlockNotFound
+		}
+
+		block, err := decodeBlock(data)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// Block found by hash in any height of chain.
+// Returns false if hash is unknown.
+// Returns true with nil block if block is pruned.
+func (chain *ChainT) BlockByHash(hash Hash) (Height, Block, bool) {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	height, ok := chain.getHeightByHash(hash)
+	if !ok {
+		return 0, nil, false
+	}
+	return height, chain.getBlock(height), true
+}
+
+// Call function for each transaction from first retained to last block.
+// Iteration stops if function returns false.
+// Lock is not held between blocks, so function can use chain.
+func (chain *ChainT) EachTransaction(fn func(Transaction, Height) bool) {
+	chain.EachBlock(0, func(block Block, height Height) bool {
+		for _, tx := range block.Transactions() {
+			if !fn(tx, height) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Call function for each block from height to last block.
+// Blocks are loaded one at a time, iteration stops
+// if function returns false. Pruned blocks are skipped.
+func (chain *ChainT) EachBlock(from Height, fn func(Block, Height) bool) {
+	chain.mtx.RLock()
+	height := chain.getHeight()
+	if pruned := chain.getPruned(); from < pruned {
+		from = pruned
+	}
+	chain.mtx.RUnlock()
+
+	for i := from; i <= height; i++ {
+		block := chain.Block(i)
+		if block == nil {
+			return
+		}
+
+		if !fn(block, i) {
+			return
+		}
+	}
+}
+
+// Number of transactions in chain.
+func (chain *ChainT) TXsNum() uint64 {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	return chain.getTXsNum()
+}
+
 func (chain *ChainT) TX(hash Hash) Transaction {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
 	return chain.getTX(hash)
 }
 
+// Check existence of transactions in chain.
+// Result is aligned with hashes by index.
+func (chain *ChainT) HasTXs(hashes []Hash) []bool {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	return chain.hasTXs(hashes)
+}
+
 func (chain *ChainT) Block(height Height) Block {
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
 	return chain.getBlock(height)
 }
 
@@ -235,21 +774,60 @@ func (chain *ChainT) setHeight(height Height) {
 	chain.blocks.Set(GetKeyHeight(), encoding.Uint64ToBytes(uint64(height)))
 }
 
+// Blocks below height are pruned.
+func (chain *ChainT) getPruned() Height {
+	data := chain.blocks.Get(GetKeyPruned())
+	if data == nil {
+		return 0
+	}
+	return Height(encoding.BytesToUint64(data))
+}
+
+func (chain *ChainT) setPruned(height Height) {
+	chain.blocks.Set(GetKeyPruned(), encoding.Uint64ToBytes(uint64(height)))
+}
+
 // TX
 
+func (chain *ChainT) hasTXs(hashes []Hash) []bool {
+	result := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		result[i] = chain.txs.Get(GetKeyTX(hash)) != nil
+	}
+	return result
+}
+
 func (chain *ChainT) getTX(hash Hash) Transaction {
 	data := chain.txs.Get(GetKeyTX(hash))
 	return LoadTransaction(data)
 }
 
 func (chain *ChainT) setTX(tx Transaction) {
+	if chain.txs.Get(GetKeyTX(tx.Hash())) == nil {
+		chain.setTXsNum(chain.getTXsNum() + 1)
+	}
 	chain.txs.Set(GetKeyTX(tx.Hash()), tx.Bytes())
 }
 
 func (chain *ChainT) delTX(hash Hash) {
+	if chain.txs.Get(GetKeyTX(hash)) != nil {
+		chain.setTXsNum(chain.getTXsNum() - 1)
+	}
 	chain.txs.Del(GetKeyTX(hash))
 }
 
+func (chain *ChainT) getTXsNum() uint64 {
+	data := chain.txs.Get(GetKeyTXsNum())
+	if data == nil {
+		return 0
+	}
+	return encoding.BytesToUint64(data)
+}
+
+func (chain *ChainT) setTXsNum(num uint64) {
+	chain.txs.Set(GetKeyTXsNum(), encoding.Uint64ToBytes(num))
+}
+
 // Block
 
 func (chain *ChainT) getBlock(height Height) Block {
@@ -257,8 +835,18 @@ func (chain *ChainT) getBlock(height Height) Block {
 	return LoadBlock(data)
 }
 
+func (chain *ChainT) getHeightByHash(hash Hash) (Height, bool) {
+	data := chain.blocks.Get(GetKeyHash(hash))
+	if data == nil {
+		return 0, false
+	}
+	return Height(encoding.BytesToUint64(data)), true
+}
+
 func (chain *ChainT) setBlock(block Block) {
-	chain.blocks.Set(GetKeyBlock(chain.Height()), block.Bytes())
+	height := chain.getHeight()
+	chain.blocks.Set(GetKeyBlock(height), block.Bytes())
+	chain.blocks.Set(GetKeyHash(block.Hash()), encoding.Uint64ToBytes(uint64(height)))
 
 	for _, tx := range block.Transactions() {
 		chain.setTX(tx)
@@ -272,12 +860,19 @@ func (chain *ChainT) delBlock(height Height) {
 		chain.delTX(tx.Hash())
 	}
 
+	chain.blocks.Del(GetKeyHash(block.Hash()))
 	chain.blocks.Del(GetKeyBlock(height))
 }
 
 func (chain *ChainT) updateBlock(height Height, block Block, delTXs []Transaction) {
 	mempool := chain.Mempool()
+
+	if oldBlock := chain.getBlock(height); oldBlock != nil {
+		chain.blocks.Del(GetKeyHash(oldBlock.Hash()))
+	}
+
 	chain.blocks.Set(GetKeyBlock(height), block.Bytes())
+	chain.blocks.Set(GetKeyHash(block.Hash()), encoding.Uint64ToBytes(uint64(height)))
 
 	for _, tx := range block.Transactions() {
 		chain.setTX(tx)
@@ -290,6 +885,66 @@ func (chain *ChainT) updateBlock(height Height, block Block, delTXs []Transactio
 	}
 }
 
+// Checkpoint
+
+func (chain *ChainT) inCheckpoint(height Height, block Block) bool {
+	hash, ok := chain.checkpoints[height]
+	if !ok {
+		return true
+	}
+	return bytes.Equal(hash, block.Hash())
+}
+
+// Results are aligned with blocks by index.
+func verifyBlocks(blocks []Block) []error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(blocks))
+		jobs = make(chan int)
+	)
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				errs[j] = verifyBlock(blocks[j])
+			}
+		}()
+	}
+
+	for i := range blocks {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+	return errs
+}
+
+func verifyBlock(block Block) error {
+	if !block.IsValid() {
+		return ErrBlockInvalid
+	}
+
+	for _, tx := range block.Transactions() {
+		if !tx.IsValid() {
+			return ErrTXInvalid
+		}
+	}
+
+	return nil
+}
+
+// Genesis links to ChainID instead of parent block,
+// so chains of different networks can not be mixed.
+func isGenesis(block Block) bool {
+	if block == nil || !block.IsValid() {
+		return false
+	}
+	return bytes.Equal(block.PrevHash(), []byte(ChainID))
+}
+
 func pathIsExist(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
@@ -0,0 +1,988 @@
+package kernel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/number571/go-peer/crypto"
+	"github.com/number571/go-peer/encoding"
+)
+
+var (
+	testPriv  = crypto.NewPrivKey(KeySize)
+	testNonce = 0
+)
+
+func newTestTXs(n int) []Transaction {
+	txs := make([]Transaction, 0, n)
+	for i := 0; i < n; i++ {
+		testNonce++
+		txs = append(txs, NewTransaction(testPriv, []byte(fmt.Sprintf("tx-%d", testNonce))))
+	}
+	return txs
+}
+
+func newTestBlock(prevHash Hash) Block {
+	return NewBlock(prevHash, newTestTXs(TXsSize))
+}
+
+func newTestChain(t *testing.T, height int) Chain {
+	chain := NewChainWithDB(
+		NewMemoryDB(),
+		NewMemoryDB(),
+		NewMemoryDB(),
+		newTestBlock([]byte(ChainID)),
+	)
+	if chain == nil {
+		t.Fatal("chain is nil")
+	}
+
+	for i := 0; i < height; i++ {
+		if !chain.Accept(newTestBlock(testTip(t, chain).Hash())) {
+			t.Fatalf("block %d not accepted", i+1)
+		}
+	}
+
+	return chain
+}
+
+func testTip(t *testing.T, chain Chain) Block {
+	tip, err := chain.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tip
+}
+
+func TestChainTip(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Close()
+
+	tip, err := chain.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tip.Hash(), chain.Block(2).Hash()) {
+		t.Fatal("tip is not last block")
+	}
+
+	// tip block is missing in storage
+	chain.(*ChainT).blocks.Del(GetKeyBlock(2))
+	if _, err := chain.Tip(); err != ErrBlockNotFound {
+		t.Fatalf("got error %v, expected %v", err, ErrBlockNotFound)
+	}
+
+	empty := loadChain(NewMemoryDB(), NewMemoryDB(), NewMemoryDB())
+	if _, err := empty.Tip(); err != ErrBlockNotFound {
+		t.Fatalf("got error %v, expected %v", err, ErrBlockNotFound)
+	}
+}
+
+func TestChainTryReorg(t *testing.T) {
+	chain := newTestChain(t, 3)
+	defer chain.Close()
+
+	var (
+		ancestor = chain.Block(1)
+		replaced = chain.Block(2).Transactions()[0]
+		orphan   = chain.Block(3).Transactions()[0]
+	)
+
+	// shared transaction must stay indexed after reorg
+	fork := []Block{
+		NewBlock(ancestor.Hash(), append(newTestTXs(TXsSize-1), replaced)),
+	}
+	for i := 0; i < 2; i++ {
+		fork = append(fork, newTestBlock(fork[i].Hash()))
+	}
+
+	if chain.TryReorg(fork[:2]) {
+		t.Fatal("branch of equal length replaced chain")
+	}
+
+	if !chain.TryReorg(fork) {
+		t.Fatal("longer branch did not replace chain")
+	}
+
+	if chain.Height() != 4 {
+		t.Fatalf("height is %d, expected 4", chain.Height())
+	}
+
+	if !bytes.Equal(testTip(t, chain).Hash(), fork[2].Hash()) {
+		t.Fatal("tip is not last block of branch")
+	}
+
+	if chain.TX(replaced.Hash()) == nil {
+		t.Fatal("transaction of branch is not indexed")
+	}
+
+	if chain.Mempool().TX(replaced.Hash()) != nil {
+		t.Fatal("transaction of branch is in mempool")
+	}
+
+	if chain.TX(orphan.Hash()) != nil {
+		t.Fatal("transaction of orphaned block is indexed")
+	}
+
+	if chain.Mempool().TX(orphan.Hash()) == nil {
+		t.Fatal("transaction of orphaned block is not in mempool")
+	}
+
+	if chain.Mempool().Height() != 2*TXsSize-1 {
+		t.Fatalf("mempool height is %d, expected %d", chain.Mempool().Height(), 2*TXsSize-1)
+	}
+
+	if chain.TXsNum() != 5*TXsSize {
+		t.Fatalf("txs num is %d, expected %d", chain.TXsNum(), 5*TXsSize)
+	}
+
+	if _, err := chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainPrune(t *testing.T) {
+	chain := newTestChain(t, 4)
+	defer chain.Close()
+
+	var (
+		pruned = chain.Block(1)
+		tx     = pruned.Transactions()[0]
+	)
+
+	if chain.Prune(5) {
+		t.Fatal("chain pruned above last block")
+	}
+
+	if !chain.Prune(2) {
+		t.Fatal("chain not pruned")
+	}
+
+	if chain.Block(1) != nil {
+		t.Fatal("pruned block is loaded")
+	}
+
+	height, block, ok := chain.BlockByHash(pruned.Hash())
+	if !ok || block != nil || height != 1 {
+		t.Fatal("pruned block is not told from unknown one")
+	}
+
+	if _, _, ok := chain.BlockByHash([]byte("unknown")); ok {
+		t.Fatal("unknown hash is found")
+	}
+
+	if chain.TX(tx.Hash()) == nil {
+		t.Fatal("transaction of pruned block is not indexed")
+	}
+
+	if height, err := chain.Verify(); err != nil || height != 4 {
+		t.Fatalf("pruned chain is invalid at %d: %v", height, err)
+	}
+
+	if !chain.Accept(newTestBlock(testTip(t, chain).Hash())) {
+		t.Fatal("block not accepted after prune")
+	}
+
+	if !chain.IsValid() {
+		t.Fatal("chain is invalid after accept")
+	}
+
+	if chain.Rollback(4) {
+		t.Fatal("chain rolled back below prune height")
+	}
+
+	// first retained block must link to last pruned one
+	ichain := chain.(*ChainT)
+	ichain.blocks.Set(GetKeyBlock(2), newTestBlock(chain.Block(3).Hash()).Bytes())
+
+	if height, err := chain.Verify(); err != ErrBlockLink || height != 2 {
+		t.Fatalf("broken link at prune height not found: %d, %v", height, err)
+	}
+}
+
+func TestChainSubscribe(t *testing.T) {
+	chain := newTestChain(t, 0)
+	defer chain.Close()
+
+	ch1, cancel1 := chain.Subscribe()
+	ch2, cancel2 := chain.Subscribe()
+	defer cancel2()
+
+	block := newTestBlock(testTip(t, chain).Hash())
+	if !chain.Accept(block) {
+		t.Fatal("block not accepted")
+	}
+
+	for _, ch := range []<-chan Block{ch1, ch2} {
+		select {
+		case got := <-ch:
+			if !bytes.Equal(got.Hash(), block.Hash()) {
+				t.Fatal("subscriber received wrong block")
+			}
+		default:
+			t.Fatal("subscriber did not receive block")
+		}
+	}
+
+	cancel1()
+	cancel1()
+
+	block = newTestBlock(testTip(t, chain).Hash())
+	if !chain.Accept(block) {
+		t.Fatal("block not accepted")
+	}
+
+	if _, ok := <-ch1; ok {
+		t.Fatal("canceled subscriber received block")
+	}
+
+	select {
+	case got := <-ch2:
+		if !bytes.Equal(got.Hash(), block.Hash()) {
+			t.Fatal("subscriber received wrong block")
+		}
+	default:
+		t.Fatal("subscriber did not receive block")
+	}
+
+	// slow subscriber does not stall chain
+	for i := 0; i < SubsSize+1; i++ {
+		if !chain.Accept(newTestBlock(testTip(t, chain).Hash())) {
+			t.Fatal("block not accepted")
+		}
+	}
+
+	if len(ch2) != SubsSize {
+		t.Fatalf("subscriber buffered %d blocks, expected %d", len(ch2), SubsSize)
+	}
+}
+
+func TestBlockVersion(t *testing.T) {
+	block := newTestBlock([]byte(ChainID)).(*BlockT)
+
+	newer := *block
+	newer.version = BlockVersion + 1
+
+	if _, err := decodeBlock(newer.Bytes()); err != ErrBlockVersion {
+		t.Fatalf("got error %v, expected %v", err, ErrBlockVersion)
+	}
+
+	if LoadBlock(newer.Bytes()) != nil {
+		t.Fatal("block of newer version is loaded")
+	}
+}
+
+// Blocks stored before versioning are hashed
+// without merkle root and have no version field.
+func newLegacyBlock(prevHash Hash) []byte {
+	block := newTestBlock(prevHash).(*BlockT)
+	block.version = BlockVersionMin
+	block.currHash = block.chainHash()
+
+	var txs [][]byte
+	for _, tx := range block.txs {
+		txs = append(txs, tx.Bytes())
+	}
+
+	data, err := json.Marshal(struct {
+		TXs      [][]byte `json:"txs"`
+		PrevHash []byte   `json:"prev_hash"`
+		CurrHash []byte   `json:"curr_hash"`
+	}{
+		TXs:      txs,
+		PrevHash: block.prevHash,
+		CurrHash: block.currHash,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestChainLegacyBlocks(t *testing.T) {
+	var (
+		blocks  = NewMemoryDB()
+		genesis = newLegacyBlock([]byte(ChainID))
+	)
+
+	blocks.Set(GetKeyHeight(), encoding.Uint64ToBytes(0))
+	blocks.Set(GetKeyBlock(0), genesis)
+
+	mempool := NewMemoryDB()
+	mempool.Set(GetKeyMempoolHeight(), encoding.Uint64ToBytes(0))
+
+	chain := LoadChainWithDB(blocks, NewMemoryDB(), mempool)
+	if chain == nil {
+		t.Fatal("chain with block without version is not loaded")
+	}
+	defer chain.Close()
+
+	if !chain.AcceptBytes(newLegacyBlock(testTip(t, chain).Hash())) {
+		t.Fatal("block without version not accepted")
+	}
+
+	if !chain.Accept(newTestBlock(testTip(t, chain).Hash())) {
+		t.Fatal("block of new version not accepted after old ones")
+	}
+
+	if height, err := chain.Verify(); err != nil || height != 2 {
+		t.Fatalf("chain is invalid at %d: %v", height, err)
+	}
+}
+
+// Chain is longer than one batch of verify.
+func TestChainVerify(t *testing.T) {
+	const (
+		height = 50
+	)
+
+	chain := newTestChain(t, height)
+	defer chain.Close()
+
+	if h, err := chain.Verify(); err != nil || h != height {
+		t.Fatalf("chain is invalid at %d: %v", h, err)
+	}
+
+	ichain := chain.(*ChainT)
+
+	// block of second batch does not link to parent
+	ichain.blocks.Set(GetKeyBlock(40), newTestBlock(chain.Block(10).Hash()).Bytes())
+	if h, err := chain.Verify(); err != ErrBlockLink || h != 40 {
+		t.Fatalf("broken link not found: %d, %v", h, err)
+	}
+
+	// earlier invalid block is reported first
+	block := newTestBlock(chain.Block(19).Hash()).(*BlockT)
+	block.currHash = chain.Block(20).Hash()
+	ichain.blocks.Set(GetKeyBlock(20), block.Bytes())
+	if h, err := chain.Verify(); err != ErrBlockInvalid || h != 20 {
+		t.Fatalf("invalid block not found: %d, %v", h, err)
+	}
+}
+
+// Blocks replaced on every check do not stop verify.
+func TestChainVerifyRewrites(t *testing.T) {
+	const (
+		height = VerifySize + 8
+	)
+
+	chain := newTestChain(t, height)
+	defer chain.Close()
+
+	var (
+		tip  = testTip(t, chain)
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if !chain.Rollback(1) || !chain.Accept(tip) {
+				t.Error("tip is not replaced")
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 8; i++ {
+		got, err := chain.Verify()
+		if err != nil {
+			t.Fatalf("chain is invalid at %d: %v", got, err)
+		}
+		if got != height && got != height-1 {
+			t.Fatalf("chain is verified to %d, expected %d", got, height)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestChainCheckpoints(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Close()
+
+	var (
+		match    = newTestBlock(testTip(t, chain).Hash())
+		mismatch = newTestBlock(testTip(t, chain).Hash())
+	)
+
+	chain.SetCheckpoints(map[Height]Hash{
+		2: chain.Block(2).Hash(),
+		3: match.Hash(),
+	})
+
+	if chain.Accept(mismatch) {
+		t.Fatal("block not matching checkpoint accepted")
+	}
+
+	if !chain.Accept(match) {
+		t.Fatal("block matching checkpoint not accepted")
+	}
+
+	if chain.Rollback(2) {
+		t.Fatal("chain rolled back below checkpoint")
+	}
+
+	// branch from block 1 replaces checkpoint at height 2
+	fork := []Block{newTestBlock(chain.Block(1).Hash())}
+	for i := 0; i < 3; i++ {
+		fork = append(fork, newTestBlock(fork[i].Hash()))
+	}
+
+	if chain.TryReorg(fork) {
+		t.Fatal("reorg replaced block of checkpoint")
+	}
+
+	if !bytes.Equal(testTip(t, chain).Hash(), match.Hash()) {
+		t.Fatal("tip is changed by rejected blocks")
+	}
+
+	if _, err := chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored block not matching checkpoint is found
+	chain.SetCheckpoints(map[Height]Hash{1: mismatch.Hash()})
+	if height, err := chain.Verify(); err != ErrCheckpoint || height != 1 {
+		t.Fatalf("checkpoint mismatch not found: %d, %v", height, err)
+	}
+}
+
+// Run with -race to find unguarded access.
+func TestChainConcurrent(t *testing.T) {
+	const (
+		numBlocks  = 16
+		numReaders = 4
+	)
+
+	chain := newTestChain(t, 0)
+	defer chain.Close()
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if tip, err := chain.Tip(); err == nil {
+					chain.BlockByHash(tip.Hash())
+				}
+				chain.Block(chain.Height())
+				chain.EachBlock(0, func(Block, Height) bool { return true })
+				if _, err := chain.Verify(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numBlocks; i++ {
+		tip, err := chain.Tip()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !chain.Accept(newTestBlock(tip.Hash())) {
+			t.Fatalf("block %d not accepted", i+1)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	if chain.Height() != numBlocks {
+		t.Fatalf("height is %d, expected %d", chain.Height(), numBlocks)
+	}
+}
+
+func TestBlockOrder(t *testing.T) {
+	block := newTestBlock([]byte(ChainID)).(*BlockT)
+	if !block.IsValid() {
+		t.Fatal("block is invalid")
+	}
+
+	// transactions are swapped and hash is recomputed,
+	// so only order of transactions is wrong
+	block.txs[0], block.txs[1] = block.txs[1], block.txs[0]
+	block.currHash = block.newHash()
+
+	if block.IsValid() {
+		t.Fatal("block with reordered transactions is valid")
+	}
+
+	if LoadBlock(block.Bytes()) != nil {
+		t.Fatal("block with reordered transactions is loaded")
+	}
+}
+
+func TestKeyValueDB(t *testing.T) {
+	backends := map[string]func(t *testing.T) KeyValueDB{
+		"memory": func(*testing.T) KeyValueDB { return NewMemoryDB() },
+		"leveldb": func(t *testing.T) KeyValueDB {
+			db := NewDB(t.TempDir())
+			if db == nil {
+				t.Fatal("leveldb is not opened")
+			}
+			return db
+		},
+	}
+
+	for name, newDB := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := newDB(t)
+			defer db.Close()
+
+			testKeyValueDB(t, db)
+		})
+	}
+}
+
+func testKeyValueDB(t *testing.T, db KeyValueDB) {
+	if db.Get([]byte("a.1")) != nil {
+		t.Fatal("missing key has value")
+	}
+
+	db.Set([]byte("b.1"), []byte("4"))
+	db.Set([]byte("a.2"), []byte("2"))
+	db.Set([]byte("a.1"), []byte("1"))
+	db.Set([]byte("a.3"), []byte("3"))
+
+	if value := db.Get([]byte("a.2")); !bytes.Equal(value, []byte("2")) {
+		t.Fatalf("got value %q, expected %q", value, "2")
+	}
+
+	db.Set([]byte("a.2"), []byte("5"))
+	if value := db.Get([]byte("a.2")); !bytes.Equal(value, []byte("5")) {
+		t.Fatalf("got overwritten value %q, expected %q", value, "5")
+	}
+
+	db.Del([]byte("a.3"))
+	if db.Get([]byte("a.3")) != nil {
+		t.Fatal("deleted key has value")
+	}
+
+	// keys of prefix only, in sorted order
+	var keys, values []string
+	iter := db.Iter([]byte("a."))
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(iter.Value()))
+	}
+	iter.Close()
+
+	if fmt.Sprint(keys) != "[a.1 a.2]" || fmt.Sprint(values) != "[1 5]" {
+		t.Fatalf("got keys %v with values %v", keys, values)
+	}
+}
+
+func TestChainLevelDB(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		genesis = newTestBlock([]byte(ChainID))
+	)
+
+	chain := NewChainWithDB(
+		NewDB(dir+"/blocks"),
+		NewDB(dir+"/txs"),
+		NewDB(dir+"/mempool"),
+		genesis,
+	)
+	if chain == nil {
+		t.Fatal("chain is nil")
+	}
+
+	if !chain.Accept(newTestBlock(genesis.Hash())) {
+		t.Fatal("block not accepted")
+	}
+	tip := testTip(t, chain)
+	chain.Close()
+
+	chain = LoadChainWithDB(
+		NewDB(dir+"/blocks"),
+		NewDB(dir+"/txs"),
+		NewDB(dir+"/mempool"),
+	)
+	if chain == nil {
+		t.Fatal("chain is not loaded")
+	}
+	defer chain.Close()
+
+	if !bytes.Equal(testTip(t, chain).Hash(), tip.Hash()) {
+		t.Fatal("tip is not persisted")
+	}
+
+	if height, err := chain.Verify(); err != nil || height != 1 {
+		t.Fatalf("chain is invalid at %d: %v", height, err)
+	}
+}
+
+func TestChainParentOf(t *testing.T) {
+	chain := newTestChain(t, 3)
+	defer chain.Close()
+
+	// extends tip
+	height, parent, ok := chain.ParentOf(newTestBlock(testTip(t, chain).Hash()))
+	if !ok || height != chain.Height() || !bytes.Equal(parent.Hash(), testTip(t, chain).Hash()) {
+		t.Fatalf("block extending tip has parent at %d", height)
+	}
+
+	// forks below tip
+	height, parent, ok = chain.ParentOf(newTestBlock(chain.Block(1).Hash()))
+	if !ok || height != 1 || !bytes.Equal(parent.Hash(), chain.Block(1).Hash()) {
+		t.Fatalf("fork block has parent at %d", height)
+	}
+
+	// parent is unknown
+	if _, _, ok := chain.ParentOf(newTestBlock([]byte("unknown"))); ok {
+		t.Fatal("orphan block has parent")
+	}
+}
+
+func TestChainEachTransaction(t *testing.T) {
+	const (
+		height = 3
+	)
+
+	chain := newTestChain(t, height)
+	defer chain.Close()
+
+	var (
+		expected []string
+		got      []string
+	)
+
+	for i := Height(0); i <= height; i++ {
+		for _, tx := range chain.Block(i).Transactions() {
+			expected = append(expected, fmt.Sprintf("%d:%X", i, tx.Hash()))
+		}
+	}
+
+	chain.EachTransaction(func(tx Transaction, height Height) bool {
+		got = append(got, fmt.Sprintf("%d:%X", height, tx.Hash()))
+		return true
+	})
+
+	if len(got) != (height+1)*TXsSize || uint64(len(got)) != chain.TXsNum() {
+		t.Fatalf("got %d transactions, expected %d", len(got), (height+1)*TXsSize)
+	}
+
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("transaction %d is %s, expected %s", i, got[i], expected[i])
+		}
+	}
+
+	count := 0
+	chain.EachTransaction(func(Transaction, Height) bool {
+		count++
+		return count < TXsSize+1
+	})
+
+	if count != TXsSize+1 {
+		t.Fatalf("iteration stopped after %d transactions, expected %d", count, TXsSize+1)
+	}
+}
+
+func TestChainAcceptBytes(t *testing.T) {
+	chain := newTestChain(t, 0)
+	defer chain.Close()
+
+	blockBytes := newTestBlock(testTip(t, chain).Hash()).Bytes()
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("garbage"),
+		blockBytes[:len(blockBytes)/2],
+	} {
+		if chain.AcceptBytes(data) {
+			t.Fatalf("bytes %q accepted", data)
+		}
+	}
+
+	if !chain.AcceptBytes(blockBytes) {
+		t.Fatal("block bytes not accepted")
+	}
+
+	if chain.Height() != 1 {
+		t.Fatalf("height is %d, expected 1", chain.Height())
+	}
+}
+
+func TestChainHasTXs(t *testing.T) {
+	chain := newTestChain(t, 1)
+	defer chain.Close()
+
+	var (
+		inChain   = testTip(t, chain).Transactions()[0].Hash()
+		inMempool = newTestTXs(1)[0]
+		absent    = newTestTXs(1)[0].Hash()
+	)
+
+	if !chain.Mempool().Push(inMempool) {
+		t.Fatal("transaction not pushed")
+	}
+
+	hashes := []Hash{absent, inChain, inMempool.Hash(), inChain}
+
+	if got := fmt.Sprint(chain.HasTXs(hashes)); got != "[false true false true]" {
+		t.Fatalf("got %s in chain", got)
+	}
+
+	if got := fmt.Sprint(chain.Mempool().HasTXs(hashes)); got != "[false false true false]" {
+		t.Fatalf("got %s in mempool", got)
+	}
+}
+
+func TestChainTXsNum(t *testing.T) {
+	chain := newTestChain(t, 0)
+	defer chain.Close()
+
+	if n := chain.TXsNum(); n != TXsSize {
+		t.Fatalf("got %d transactions in genesis, expected %d", n, TXsSize)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !chain.Accept(newTestBlock(testTip(t, chain).Hash())) {
+			t.Fatalf("block %d not accepted", i+1)
+		}
+	}
+
+	if n := chain.TXsNum(); n != 4*TXsSize {
+		t.Fatalf("got %d transactions, expected %d", n, 4*TXsSize)
+	}
+
+	if !chain.Rollback(2) {
+		t.Fatal("chain not rolled back")
+	}
+
+	if n := chain.TXsNum(); n != 2*TXsSize {
+		t.Fatalf("got %d transactions after rollback, expected %d", n, 2*TXsSize)
+	}
+}
+
+func TestMempoolPush(t *testing.T) {
+	db := NewMemoryDB()
+	db.Set(GetKeyMempoolHeight(), encoding.Uint64ToBytes(MempoolSize-2))
+
+	var (
+		mempool = &MempoolT{ptr: db}
+		txs     = newTestTXs(3)
+	)
+
+	if !mempool.Push(txs[0]) {
+		t.Fatal("transaction not pushed")
+	}
+
+	if mempool.Push(txs[0]) {
+		t.Fatal("duplicate transaction pushed")
+	}
+
+	if !mempool.Push(txs[1]) {
+		t.Fatal("transaction not pushed")
+	}
+
+	// mempool is full
+	if mempool.Push(txs[2]) {
+		t.Fatal("transaction pushed over capacity")
+	}
+
+	if mempool.Height() != MempoolSize {
+		t.Fatalf("mempool height is %d, expected %d", mempool.Height(), MempoolSize)
+	}
+
+	mempool.Delete(txs[0].Hash())
+	if !mempool.Push(txs[2]) {
+		t.Fatal("transaction not pushed after delete")
+	}
+}
+
+func TestChainBlock(t *testing.T) {
+	const (
+		height = 3
+	)
+
+	chain := newTestChain(t, height)
+	defer chain.Close()
+
+	genesis := chain.Block(0)
+	if genesis == nil || !bytes.Equal(genesis.PrevHash(), []byte(ChainID)) {
+		t.Fatal("genesis is not found")
+	}
+
+	last := chain.Block(height)
+	if last == nil || !bytes.Equal(last.Hash(), testTip(t, chain).Hash()) {
+		t.Fatal("last block is not tip")
+	}
+
+	if chain.Block(height+1) != nil {
+		t.Fatal("block above tip is found")
+	}
+
+	for i := Height(0); i <= height; i++ {
+		got, block, ok := chain.BlockByHash(chain.Block(i).Hash())
+		if !ok || got != i || !bytes.Equal(block.Hash(), chain.Block(i).Hash()) {
+			t.Fatalf("block %d is found at %d", i, got)
+		}
+	}
+
+	if _, _, ok := chain.BlockByHash([]byte("unknown")); ok {
+		t.Fatal("unknown hash is found")
+	}
+}
+
+func TestChainID(t *testing.T) {
+	other := newTestBlock([]byte("other.block"))
+
+	if NewChainWithDB(NewMemoryDB(), NewMemoryDB(), NewMemoryDB(), other) != nil {
+		t.Fatal("chain with genesis of other id is created")
+	}
+
+	// genesis of other id is stored
+	blocks := NewMemoryDB()
+	blocks.Set(GetKeyHeight(), encoding.Uint64ToBytes(0))
+	blocks.Set(GetKeyBlock(0), other.Bytes())
+
+	if LoadChainWithDB(blocks, NewMemoryDB(), NewMemoryDB()) != nil {
+		t.Fatal("chain with genesis of other id is loaded")
+	}
+
+	chain := newTestChain(t, 1)
+	defer chain.Close()
+
+	// blocks of other chain do not link to this one
+	var (
+		next   = newTestBlock(other.Hash())
+		branch = []Block{next, newTestBlock(next.Hash())}
+	)
+
+	if chain.Accept(next) {
+		t.Fatal("block of other chain accepted")
+	}
+
+	if chain.TryReorg(branch) {
+		t.Fatal("branch of other chain accepted")
+	}
+
+	if _, _, ok := chain.ParentOf(next); ok {
+		t.Fatal("block of other chain has parent")
+	}
+
+	if chain.Height() != 1 {
+		t.Fatalf("height is %d, expected 1", chain.Height())
+	}
+}
+
+func TestChainEachBlock(t *testing.T) {
+	const (
+		height = 5
+	)
+
+	chain := newTestChain(t, height)
+	defer chain.Close()
+
+	var sum Height
+	chain.EachBlock(0, func(block Block, height Height) bool {
+		if !bytes.Equal(block.Hash(), chain.Block(height).Hash()) {
+			t.Fatalf("block at %d is not of chain", height)
+		}
+		sum += height
+		return true
+	})
+
+	if sum != height*(height+1)/2 {
+		t.Fatalf("got sum of heights %d, expected %d", sum, height*(height+1)/2)
+	}
+
+	var visited []Height
+	chain.EachBlock(2, func(_ Block, height Height) bool {
+		visited = append(visited, height)
+		return height < 3
+	})
+
+	if fmt.Sprint(visited) != "[2 3]" {
+		t.Fatalf("visited blocks %v, expected [2 3]", visited)
+	}
+}
+
+func TestBlockTXsSize(t *testing.T) {
+	if NewBlock([]byte(ChainID), newTestTXs(TXsSize+1)) != nil {
+		t.Fatal("block over limit is created")
+	}
+
+	if NewBlock([]byte(ChainID), newTestTXs(TXsSize-1)) != nil {
+		t.Fatal("block under limit is created")
+	}
+
+	// hash of block is recomputed, so only size is wrong
+	block := newTestBlock([]byte(ChainID)).(*BlockT)
+	block.txs = append(block.txs, newTestTXs(1)...)
+	sort.SliceStable(block.txs, func(i, j int) bool {
+		return bytes.Compare(block.txs[i].Hash(), block.txs[j].Hash()) < 0
+	})
+	block.currHash = block.newHash()
+
+	if block.IsValid() {
+		t.Fatal("block over limit is valid")
+	}
+
+	if LoadBlock(block.Bytes()) != nil {
+		t.Fatal("block over limit is loaded")
+	}
+}
+
+// Failed decoding returns nil without panic.
+func TestLoadFailed(t *testing.T) {
+	var (
+		block = newTestBlock([]byte(ChainID)).Bytes()
+		tx    = newTestTXs(1)[0].Bytes()
+	)
+
+	tests := map[string][]byte{
+		"nil":       nil,
+		"empty":     {},
+		"garbage":   []byte("garbage"),
+		"null":      []byte("null"),
+		"no key":    []byte(`{"txs":[{}]}`),
+		"truncated": block[:len(block)/2],
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if LoadBlock(data) != nil {
+				t.Fatal("block is loaded")
+			}
+			if LoadTransaction(data) != nil {
+				t.Fatal("transaction is loaded")
+			}
+		})
+	}
+
+	if LoadTransaction(tx[:len(tx)/2]) != nil {
+		t.Fatal("truncated transaction is loaded")
+	}
+}
@@ -6,14 +6,26 @@ func GetKeyHeight() []byte {
 	return []byte(KeyHeight)
 }
 
+func GetKeyPruned() []byte {
+	return []byte(KeyPruned)
+}
+
 func GetKeyBlock(height Height) []byte {
 	return []byte(fmt.Sprintf(KeyBlock, height))
 }
 
+func GetKeyHash(hash Hash) []byte {
+	return []byte(fmt.Sprintf(KeyHash, hash))
+}
+
 func GetKeyTX(hash Hash) []byte {
 	return []byte(fmt.Sprintf(KeyTX, hash))
 }
 
+func GetKeyTXsNum() []byte {
+	return []byte(KeyTXsNum)
+}
+
 func GetKeyMempoolHeight() []byte {
 	return []byte(KeyMempoolHeight)
 }
@@ -0,0 +1,13 @@
+package kernel
+
+var (
+	_ Logger = &nopLoggerT{}
+)
+
+// Logger used until chain is given one.
+type nopLoggerT struct{}
+
+func (lg *nopLoggerT) Debug(string, ...interface{}) {}
+func (lg *nopLoggerT) Info(string, ...interface{})  {}
+func (lg *nopLoggerT) Warn(string, ...interface{})  {}
+func (lg *nopLoggerT) Error(string, ...interface{}) {}
@@ -0,0 +1,96 @@
+package kernel
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	_ KeyValueDB = &MemoryDBT{}
+	_ Iterator   = &MemoryIteratorT{}
+)
+
+type MemoryDBT struct {
+	mtx sync.Mutex
+	ptr map[string][]byte
+}
+
+func NewMemoryDB() KeyValueDB {
+	return &MemoryDBT{ptr: make(map[string][]byte)}
+}
+
+// Iterator over snapshot of keys with prefix in sorted order.
+func (db *MemoryDBT) Iter(prefix []byte) Iterator {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	iter := &MemoryIteratorT{index: -1}
+	for key := range db.ptr {
+		if !strings.HasPrefix(key, string(prefix)) {
+			continue
+		}
+		iter.keys = append(iter.keys, key)
+	}
+
+	sort.Strings(iter.keys)
+	for _, key := range iter.keys {
+		iter.values = append(iter.values, db.ptr[key])
+	}
+
+	return iter
+}
+
+func (db *MemoryDBT) Set(key []byte, value []byte) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	db.ptr[string(key)] = copyBytes(value)
+}
+
+func (db *MemoryDBT) Get(key []byte) []byte {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	data, ok := db.ptr[string(key)]
+	if !ok {
+		return nil
+	}
+	return copyBytes(data)
+}
+
+func (db *MemoryDBT) Del(key []byte) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	delete(db.ptr, string(key))
+}
+
+func (db *MemoryDBT) Close() {}
+
+type MemoryIteratorT struct {
+	index  int
+	keys   []string
+	values [][]byte
+}
+
+func (iter *MemoryIteratorT) Next() bool {
+	iter.index++
+	return iter.index < len(iter.keys)
+}
+
+func (iter *MemoryIteratorT) Key() []byte {
+	return []byte(iter.keys[iter.index])
+}
+
+func (iter *MemoryIteratorT) Value() []byte {
+	return iter.values[iter.index]
+}
+
+func (iter *MemoryIteratorT) Close() {}
+
+func copyBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
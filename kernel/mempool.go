@@ -28,6 +28,16 @@ func (mempool *MempoolT) TX(hash Hash) Transaction {
 	return LoadTransaction(data)
 }
 
+// Check existence of transactions in mempool.
+// Result is aligned with hashes by index.
+func (mempool *MempoolT) HasTXs(hashes []Hash) []bool {
+	result := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		result[i] = mempool.ptr.Get(GetKeyMempoolTX(hash)) != nil
+	}
+	return result
+}
+
 func (mempool *MempoolT) Delete(hash Hash) {
 	mempool.mtx.Lock()
 	defer mempool.mtx.Unlock()
@@ -54,7 +64,8 @@ func (mempool *MempoolT) Clear() {
 	}
 }
 
-func (mempool *MempoolT) Push(tx Transaction) {
+// Returns false if mempool is full or has transaction.
+func (mempool *MempoolT) Push(tx Transaction) bool {
 	mempool.mtx.Lock()
 	defer mempool.mtx.Unlock()
 
@@ -64,15 +75,16 @@ func (mempool *MempoolT) Push(tx Transaction) {
 	)
 
 	if newHeight > MempoolSize {
-		return
+		return false
 	}
 
 	if mempool.TX(hash) != nil {
-		return
+		return false
 	}
 
 	mempool.ptr.Set(GetKeyMempoolHeight(), encoding.Uint64ToBytes(newHeight))
 	mempool.ptr.Set(GetKeyMempoolTX(hash), tx.Bytes())
+	return true
 }
 
 func (mempool *MempoolT) Pop() []Transaction {
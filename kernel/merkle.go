@@ -0,0 +1,107 @@
+package kernel
+
+import (
+	"bytes"
+
+	"github.com/number571/go-peer/crypto"
+)
+
+// Root of binary hash tree over hashes.
+// Last node of odd level is paired with itself.
+func MerkleRoot(hashes []Hash) Hash {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	level := merkleLeaves(hashes)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+
+	return level[0]
+}
+
+// Check that hash with index of leaf is under root.
+func VerifyMerkleProof(root, hash Hash, index int, proof []Hash) bool {
+	if index < 0 {
+		return false
+	}
+
+	hash = merkleLeaf(hash)
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			hash = merkleNode(hash, sibling)
+		} else {
+			hash = merkleNode(sibling, hash)
+		}
+		index /= 2
+	}
+
+	return index == 0 && bytes.Equal(root, hash)
+}
+
+// Sibling hashes from leaf by index to root.
+func merkleProof(hashes []Hash, index int) []Hash {
+	var (
+		proof []Hash
+		level = merkleLeaves(hashes)
+	)
+
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling == len(level) {
+			sibling = index
+		}
+		proof = append(proof, level[sibling])
+
+		level = merkleLevel(level)
+		index /= 2
+	}
+
+	return proof
+}
+
+func merkleLevel(level []Hash) []Hash {
+	var next []Hash
+
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, merkleNode(level[i], right))
+	}
+
+	return next
+}
+
+func merkleLeaves(hashes []Hash) []Hash {
+	leaves := make([]Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		leaves = append(leaves, merkleLeaf(hash))
+	}
+	return leaves
+}
+
+// Prefixes separate leaves from nodes of tree,
+// so node can not be proven as leaf.
+func merkleLeaf(hash Hash) Hash {
+	return crypto.NewSHA256(bytes.Join(
+		[][]byte{
+			{0x00},
+			hash,
+		},
+		[]byte{},
+	)).Bytes()
+}
+
+func merkleNode(left, right Hash) Hash {
+	return crypto.NewSHA256(bytes.Join(
+		[][]byte{
+			{0x01},
+			left,
+			right,
+		},
+		[]byte{},
+	)).Bytes()
+}
@@ -0,0 +1,117 @@
+package kernel
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/number571/go-peer/crypto"
+)
+
+func newTestHashes(n int) []Hash {
+	hashes := make([]Hash, 0, n)
+	for i := 0; i < n; i++ {
+		hashes = append(hashes, crypto.NewSHA256([]byte(fmt.Sprintf("leaf-%d", i))).Bytes())
+	}
+	return hashes
+}
+
+func TestMerkleSingle(t *testing.T) {
+	hashes := newTestHashes(1)
+
+	root := MerkleRoot(hashes)
+	if !bytes.Equal(root, merkleLeaf(hashes[0])) {
+		t.Fatal("root of single leaf is not hash of leaf")
+	}
+
+	proof := merkleProof(hashes, 0)
+	if len(proof) != 0 {
+		t.Fatal("proof of single leaf is not empty")
+	}
+
+	if !VerifyMerkleProof(root, hashes[0], 0, proof) {
+		t.Fatal("proof of single leaf is invalid")
+	}
+
+	if VerifyMerkleProof(root, hashes[0], 1, proof) {
+		t.Fatal("proof is valid for wrong index")
+	}
+}
+
+// Odd levels pair last node with itself.
+func TestMerkleOdd(t *testing.T) {
+	for _, n := range []int{3, 5, 7} {
+		hashes := newTestHashes(n)
+		root := MerkleRoot(hashes)
+
+		for i, hash := range hashes {
+			proof := merkleProof(hashes, i)
+			if !VerifyMerkleProof(root, hash, i, proof) {
+				t.Fatalf("proof of leaf %d of %d is invalid", i, n)
+			}
+		}
+	}
+
+	leaves := merkleLeaves(newTestHashes(5))
+	last := merkleNode(merkleNode(leaves[4], leaves[4]), merkleNode(leaves[4], leaves[4]))
+	root := merkleNode(
+		merkleNode(
+			merkleNode(leaves[0], leaves[1]),
+			merkleNode(leaves[2], leaves[3]),
+		),
+		last,
+	)
+
+	if !bytes.Equal(MerkleRoot(newTestHashes(5)), root) {
+		t.Fatal("root of 5 leaves is wrong")
+	}
+}
+
+func TestMerkleBlock(t *testing.T) {
+	block := newTestBlock([]byte(ChainID))
+	if block == nil {
+		t.Fatal("block is nil")
+	}
+
+	root := block.MerkleRoot()
+	for _, tx := range block.Transactions() {
+		proof, index := block.MerkleProof(tx.Hash())
+		if index < 0 {
+			t.Fatal("transaction of block not found")
+		}
+
+		if !VerifyMerkleProof(root, tx.Hash(), index, proof) {
+			t.Fatalf("proof of transaction %d is invalid", index)
+		}
+	}
+
+	absent := newTestTXs(1)[0]
+	if proof, index := block.MerkleProof(absent.Hash()); proof != nil || index >= 0 {
+		t.Fatal("proof of absent transaction found")
+	}
+
+	proof, index := block.MerkleProof(block.Transactions()[0].Hash())
+	if VerifyMerkleProof(root, absent.Hash(), index, proof) {
+		t.Fatal("proof is valid for absent transaction")
+	}
+}
+
+// Node of tree with shortened proof is not a leaf.
+func TestMerkleNodeAsLeaf(t *testing.T) {
+	var (
+		hashes = newTestHashes(4)
+		leaves = merkleLeaves(hashes)
+		root   = MerkleRoot(hashes)
+	)
+
+	node := merkleNode(leaves[0], leaves[1])
+	proof := []Hash{merkleNode(leaves[2], leaves[3])}
+
+	if VerifyMerkleProof(root, node, 0, proof) {
+		t.Fatal("node of tree is proven as leaf")
+	}
+
+	if !VerifyMerkleProof(root, hashes[0], 0, merkleProof(hashes, 0)) {
+		t.Fatal("proof of leaf is invalid")
+	}
+}
@@ -1,8 +1,17 @@
 package kernel
 
+const (
+	BlockVersion    = 2               // format of new serialized blocks
+	BlockVersionMin = 1               // format of blocks serialized without version
+	ChainID         = "genesis.block" // previous hash of genesis block
+)
+
 const (
 	KeySize     = 1024 // num bits
 	MempoolSize = 1000 // max num txs in mempool
+	SubsSize    = 16   // blocks buffered for subscriber
+	VerifySize  = 32   // blocks loaded at once by verify
+	VerifyRetry = 4    // checks restarted by replaced blocks
 
 	TXsSize     = 32   // num txs in block
 	PayloadSize = 1024 // num bytes in tx.payload
@@ -12,8 +21,11 @@ const (
 	MempoolPath = "mempool.db"
 
 	KeyHeight = "chain.blocks.height"
+	KeyPruned = "chain.blocks.pruned"
 	KeyBlock  = "chain.blocks.block[%d]"
+	KeyHash   = "chain.blocks.hash[%X]"
 	KeyTX     = "chain.txs.tx[%X]"
+	KeyTXsNum = "chain.txs.count"
 
 	KeyMempoolHeight   = "chain.mempool.height"
 	KeyMempoolTX       = "chain.mempool.tx[%X]"
@@ -2,6 +2,7 @@ package kernel
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 
@@ -51,24 +52,38 @@ func NewTransaction(priv PrivKey, payLoad []byte) Transaction {
 }
 
 func LoadTransaction(txbytes []byte) Transaction {
+	tx := decodeTransaction(txbytes)
+	if tx == nil {
+		return nil
+	}
+
+	if !tx.IsValid() {
+		return nil
+	}
+
+	return tx
+}
+
+// Transaction is not validated.
+func decodeTransaction(txbytes []byte) *TransactionT {
 	txConv := new(txJSON)
 	err := json.Unmarshal(txbytes, txConv)
 	if err != nil {
 		return nil
 	}
 
-	tx := &TransactionT{
+	// loaded key is not checked and panics
+	// if its bytes are missing or malformed
+	if _, err := x509.ParsePKCS1PublicKey(txConv.Validator); err != nil {
+		return nil
+	}
+
+	return &TransactionT{
 		payLoad:   txConv.PayLoad,
 		hash:      txConv.Hash,
 		sign:      txConv.Sign,
 		validator: crypto.LoadPubKey(txConv.Validator),
 	}
-
-	if !tx.IsValid() {
-		return nil
-	}
-
-	return tx
 }
 
 func (tx *TransactionT) PayLoad() []byte {
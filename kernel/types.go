@@ -28,6 +28,14 @@ type Signifier interface {
 	Hasher
 }
 
+// Messages are logged with key-value pairs.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
 type Iterator interface {
 	Next() bool
 	Key() []byte
@@ -46,8 +54,9 @@ type KeyValueDB interface {
 type Mempool interface {
 	Height() Height
 	TX(Hash) Transaction
+	HasTXs([]Hash) []bool
 
-	Push(Transaction)
+	Push(Transaction) bool
 	Pop() []Transaction
 
 	Delete(Hash)
@@ -56,12 +65,28 @@ type Mempool interface {
 
 type Chain interface {
 	Accept(Block) bool
+	AcceptBytes([]byte) bool
 	Merge(Height, []Transaction) bool
+	TryReorg([]Block) bool
 	Rollback(uint64) bool
+	SetCheckpoints(map[Height]Hash)
+	SetLogger(Logger)
+	Prune(Height) bool
 
 	Height() Height
+	Tip() (Block, error)
+	TXsNum() uint64
 	TX(Hash) Transaction
+	HasTXs([]Hash) []bool
 	Block(Height) Block
+	BlockByHash(Hash) (Height, Block, bool)
+	IsValid() bool
+	Verify() (Height, error)
+	ParentOf(Block) (Height, Block, bool)
+	EachTransaction(func(Transaction, Height) bool)
+	EachBlock(Height, func(Block, Height) bool)
+
+	Subscribe() (<-chan Block, func())
 
 	Mempool() Mempool
 	Close()
@@ -70,6 +95,8 @@ type Chain interface {
 type Block interface {
 	PrevHash() Hash
 	Transactions() []Transaction
+	MerkleRoot() Hash
+	MerkleProof(Hash) ([]Hash, int)
 
 	Wrapper
 	Hasher
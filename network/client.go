@@ -0,0 +1,136 @@
+package network
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	_ Client = &ClientT{}
+)
+
+// Client sends requests to node and matches
+// responses with requests by nonce.
+type ClientT struct {
+	mtx   sync.Mutex
+	conn  *ConnT
+	waits map[string]chan Message
+}
+
+// Connect to node by address as client.
+// Dial is limited by default connect timeout.
+func NewClient(address string) (Client, error) {
+	conn, err := net.DialTimeout("tcp", address, DialTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(conn, address), nil
+}
+
+// Connect to node listening with TLS as client.
+func NewClientTLS(address string, cfg *tls.Config) (Client, error) {
+	dialer := &net.Dialer{Timeout: DialTime}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(conn, address), nil
+}
+
+func newClient(conn net.Conn, address string) *ClientT {
+	conn.Write([]byte{IsClient})
+
+	client := &ClientT{
+		conn:  newConn(conn, address, false),
+		waits: make(map[string]chan Message),
+	}
+
+	go client.readResponses()
+	return client
+}
+
+// Send request and wait response with the same nonce.
+// Returns nil if timeout expired or client was closed.
+func (client *ClientT) Request(msg Message) Message {
+	ch, ok := client.setWait(msg.Nonce())
+	if !ok {
+		return nil
+	}
+	defer client.delWait(msg.Nonce())
+
+	client.conn.Write(msg)
+
+	select {
+	case rmsg := <-ch:
+		return rmsg
+	case <-client.conn.closed:
+		return nil
+	case <-time.After(TimeSize * time.Second):
+		return nil
+	}
+}
+
+// Close connection and fail all waiting requests.
+func (client *ClientT) Close() error {
+	return client.conn.Close()
+}
+
+func (client *ClientT) readResponses() {
+	defer client.conn.Close()
+
+	counter := 0
+
+	for counter != RetrySize {
+		msg := client.conn.Read()
+		if client.conn.isClosed() {
+			return
+		}
+
+		if msg == nil {
+			counter++
+			continue
+		}
+
+		counter = 0
+		client.response(msg)
+	}
+}
+
+func (client *ClientT) response(msg Message) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	ch, ok := client.waits[string(msg.Nonce())]
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+func (client *ClientT) setWait(nonce []byte) (chan Message, bool) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	if client.conn.isClosed() {
+		return nil, false
+	}
+
+	ch := make(chan Message, 1)
+	client.waits[string(nonce)] = ch
+	return ch, true
+}
+
+func (client *ClientT) delWait(nonce []byte) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	delete(client.waits, string(nonce))
+}
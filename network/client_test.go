@@ -0,0 +1,105 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientRequest(t *testing.T) {
+	const (
+		numRequests = 16
+	)
+
+	node, address := newTestNode(t, NodeConfig{})
+	node.Handle(1, func(_ Node, conn Conn, msg Message) {
+		conn.Write(NewResponse(msg, 2, msg.Body()))
+	})
+
+	client, err := NewClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// concurrent requests do not cross replies
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			body := fmt.Sprintf("request-%d", i)
+			resp := client.Request(NewMessage(1, []byte(body)))
+			if resp == nil {
+				t.Error("response not received")
+				return
+			}
+
+			if string(resp.Body()) != body {
+				t.Errorf("got response %q, expected %q", resp.Body(), body)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientClose(t *testing.T) {
+	_, address := newTestNode(t, NodeConfig{})
+
+	client, err := NewClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { client.Close() })
+
+	// node has no route, so request is never answered
+	start := time.Now()
+	if client.Request(NewMessage(1, nil)) != nil {
+		t.Fatal("response received without route")
+	}
+
+	if time.Since(start) >= TimeSize*time.Second {
+		t.Fatal("request is not failed by close")
+	}
+
+	if client.Request(NewMessage(1, nil)) != nil {
+		t.Fatal("response received after close")
+	}
+}
+
+// Request fails without panic if node sends no response.
+func TestClientRequestFailed(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("garbage"))
+		conn.Close()
+	}()
+
+	client, err := NewClient(listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.Request(NewMessage(1, nil)) != nil {
+		t.Fatal("response received from closed connection")
+	}
+
+	// request of closed client fails at once
+	if client.Request(NewMessage(1, nil)) != nil {
+		t.Fatal("response received by closed client")
+	}
+}
@@ -3,8 +3,11 @@ package network
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/number571/go-peer/crypto"
@@ -14,118 +17,443 @@ var (
 	_ Conn = &ConnT{}
 )
 
+var (
+	ErrReadTimeout = errors.New("network: read deadline expired")
+	ErrReadFailed  = errors.New("network: message can not be read")
+	ErrMsgVersion  = errors.New("network: message is of unsupported version")
+)
+
 type ConnT struct {
-	nonce string
-	ptr   net.Conn
+	mtx        sync.Mutex
+	once       sync.Once
+	nonce      string
+	id         string
+	moniker    string
+	listen     string
+	address    string
+	inbound    bool
+	persistent bool
+	ptr        net.Conn
+	queue      [PrioritySize]chan Message
+	closed     chan struct{}
+	starve     uint
+	pending    int64
+	dropped    uint64
+	lastSeen   int64
+	tokens     float64
+	fillTime   time.Time
+	rateDrops  uint
+	rateTime   time.Time
+	packSize   uint64
+	readTime   time.Duration
+	sendTime   time.Duration
 }
 
+// Connect to node by address as client.
+//
+// Deprecated: use NewClient, which matches
+// responses with requests by nonce.
 func NewConn(address string) Conn {
-	conn, err := net.Dial("tcp", address)
+	conn, err := net.DialTimeout("tcp", address, DialTime)
 	if err != nil {
 		return nil
 	}
 
 	conn.Write([]byte{IsClient})
-	return &ConnT{crypto.RandString(16), conn}
+	return newConn(conn, address, false)
+}
+
+func newConn(conn net.Conn, address string, inbound bool) *ConnT {
+	iconn := &ConnT{
+		nonce:    crypto.RandString(16),
+		address:  address,
+		inbound:  inbound,
+		ptr:      conn,
+		closed:   make(chan struct{}),
+		lastSeen: time.Now().UnixNano(),
+		packSize: PackSize,
+	}
+	for i := range iconn.queue {
+		iconn.queue[i] = make(chan Message, QueueSize)
+	}
+	go iconn.sendQueue()
+	return iconn
 }
 
+// Send message and wait response.
+// Returns nil if response not received.
+//
+// Deprecated: use Client.Request, since message
+// read here can be response to other request.
 func (conn *ConnT) Request(msg Message) Message {
 	conn.Write(msg)
 
-	ch := make(chan Message)
-	go readMessage(conn, ch)
+	ch := make(chan Message, 1)
+	go func() {
+		msg, _ := conn.readMessage()
+		ch <- msg
+	}()
 
 	select {
 	case rmsg := <-ch:
 		return rmsg
 	case <-time.After(TimeSize * time.Second):
-		fmt.Println(777)
 		return nil
 	}
 }
 
 func (conn *ConnT) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+	})
 	return conn.ptr.Close()
 }
 
 func (conn *ConnT) Write(msg Message) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+
+	conn.setWriteDeadline()
 	conn.ptr.Write(msg.Bytes())
 }
 
+func (conn *ConnT) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Moniker of remote node.
+// Empty for client connections.
+func (conn *ConnT) Moniker() string {
+	return conn.moniker
+}
+
+// Address to dial remote node.
+// For inbound connections advertised listen port is used.
+func (conn *ConnT) peerAddress() string {
+	if !conn.inbound || conn.listen == "" {
+		return conn.address
+	}
+
+	host, _, err := net.SplitHostPort(conn.address)
+	if err != nil {
+		return conn.address
+	}
+
+	_, port, err := net.SplitHostPort(conn.listen)
+	if err != nil {
+		return conn.address
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// Inbound peer is banned by remote host, so it can not
+// come back from another port or without listener.
+func (conn *ConnT) banAddress() string {
+	if !conn.inbound {
+		return conn.address
+	}
+
+	host, _, err := net.SplitHostPort(conn.address)
+	if err != nil {
+		return conn.address
+	}
+
+	return host
+}
+
+// Remote address of connection.
+func (conn *ConnT) Address() string {
+	return conn.address
+}
+
+// Time of last message received from connection.
+func (conn *ConnT) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastSeen))
+}
+
+func (conn *ConnT) seen() {
+	atomic.StoreInt64(&conn.lastSeen, time.Now().UnixNano())
+}
+
+// Token bucket of received messages.
+// Used only by reading goroutine of connection.
+func (conn *ConnT) allow(rate float64, burst uint) bool {
+	now := time.Now()
+	if conn.fillTime.IsZero() {
+		conn.tokens = float64(burst)
+	} else {
+		conn.tokens += now.Sub(conn.fillTime).Seconds() * rate
+		if conn.tokens > float64(burst) {
+			conn.tokens = float64(burst)
+		}
+	}
+	conn.fillTime = now
+
+	if conn.tokens < 1 {
+		return false
+	}
+	conn.tokens--
+	return true
+}
+
+// Count message dropped by rate limit.
+// Returns true if limit of drops is reached in window,
+// so peer exceeding rate by any amount is detected.
+// Used only by reading goroutine of connection.
+func (conn *ConnT) flooded(limit uint) bool {
+	now := time.Now()
+	if now.Sub(conn.rateTime) > RateWindow {
+		conn.rateDrops = 0
+		conn.rateTime = now
+	}
+
+	conn.rateDrops++
+	return conn.rateDrops >= limit
+}
+
+// Number of messages dropped because send queue was full.
+func (conn *ConnT) Dropped() uint64 {
+	return atomic.LoadUint64(&conn.dropped)
+}
+
+// Put message to send queue without blocking.
+// Message is dropped if queue is full or connection is closed.
+func (conn *ConnT) enqueue(msg Message, prio Priority) bool {
+	if conn.isClosed() {
+		atomic.AddUint64(&conn.dropped, 1)
+		return false
+	}
+
+	atomic.AddInt64(&conn.pending, 1)
+	select {
+	case conn.queue[prio] <- msg:
+		return true
+	default:
+		atomic.AddInt64(&conn.pending, -1)
+		atomic.AddUint64(&conn.dropped, 1)
+		return false
+	}
+}
+
+func (conn *ConnT) sendQueue() {
+	for {
+		msg := conn.nextMessage()
+		if msg == nil {
+			return
+		}
+		conn.Write(msg)
+		atomic.AddInt64(&conn.pending, -1)
+	}
+}
+
+// Take message with highest priority.
+// After StarveSize messages lowest priority is taken first once,
+// so low priority queues are not starved.
+func (conn *ConnT) nextMessage() Message {
+	order := []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+	if conn.starve >= StarveSize {
+		order = []Priority{PriorityLow, PriorityNormal, PriorityHigh}
+		conn.starve = 0
+	}
+
+	for _, prio := range order {
+		select {
+		case msg := <-conn.queue[prio]:
+			conn.starve++
+			return msg
+		default:
+		}
+	}
+
+	select {
+	case <-conn.closed:
+		return nil
+	case msg := <-conn.queue[PriorityHigh]:
+		return msg
+	case msg := <-conn.queue[PriorityNormal]:
+		return msg
+	case msg := <-conn.queue[PriorityLow]:
+		return msg
+	}
+}
+
+// Wait until all pending writes are done or timeout expired.
+// Pending writes of closed connection are never done.
+func (conn *ConnT) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&conn.pending) != 0 {
+		if conn.isClosed() || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(DrainTime)
+	}
+	return true
+}
+
+// Deadlines are not set if timeouts are zero.
+func (conn *ConnT) setReadDeadline() {
+	if conn.readTime == 0 {
+		return
+	}
+	conn.ptr.SetReadDeadline(time.Now().Add(conn.readTime))
+}
+
+func (conn *ConnT) setWriteDeadline() {
+	if conn.sendTime == 0 {
+		return
+	}
+	conn.ptr.SetWriteDeadline(time.Now().Add(conn.sendTime))
+}
+
+// Handshake of nodes is identifier, moniker and listen address.
+func (conn *ConnT) writeHandshake(id, moniker, listen string) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+
+	conn.setWriteDeadline()
+	conn.ptr.Write(bytes.Join(
+		[][]byte{
+			stringToBytes(id),
+			stringToBytes(moniker),
+			stringToBytes(listen),
+		},
+		[]byte{},
+	))
+}
+
+func (conn *ConnT) readHandshake() bool {
+	conn.setReadDeadline()
+
+	id, ok := conn.readString()
+	if !ok {
+		return false
+	}
+
+	moniker, ok := conn.readString()
+	if !ok {
+		return false
+	}
+
+	listen, ok := conn.readString()
+	if !ok {
+		return false
+	}
+
+	conn.id = id
+	conn.moniker = moniker
+	conn.listen = listen
+	return true
+}
+
+// String is sent as size in big endian bytes and string.
+func stringToBytes(str string) []byte {
+	pack := PackageT(str)
+	return bytes.Join(
+		[][]byte{
+			pack.SizeToBytes(),
+			pack.Bytes(),
+		},
+		[]byte{},
+	)
+}
+
+func (conn *ConnT) readString() (string, bool) {
+	buflen := make([]byte, 8)
+	if _, err := io.ReadFull(conn.ptr, buflen); err != nil {
+		return "", false
+	}
+
+	size := PackageT(buflen).BytesToSize()
+	if size > MonikerSize {
+		return "", false
+	}
+
+	str := make([]byte, size)
+	if _, err := io.ReadFull(conn.ptr, str); err != nil {
+		return "", false
+	}
+
+	return string(str), true
+}
+
+// Read next message from connection.
+// Returns nil if no complete message was read.
 func (conn *ConnT) Read() Message {
-	ch := make(chan Message)
-	go readMessage(conn, ch)
-	return <-ch
+	msg, _ := conn.readMessage()
+	return msg
 }
 
-func readMessage(conn *ConnT, ch chan Message) {
+// Timeout error is returned only if deadline expired
+// before message, connection is kept open in this case.
+func (conn *ConnT) readMessage() (Message, error) {
 	const (
 		SizeUint64 = 8 // bytes
 	)
 
 	var (
-		pack   []byte
-		size   = uint64(0)
 		msg    = new(MessageT)
 		buflen = make([]byte, SizeUint64)
 	)
 
-	length, err := conn.ptr.Read(buflen)
-	if err != nil {
-		// fmt.Println(111)
-		ch <- nil
-		return
-	}
+	conn.setReadDeadline()
 
-	if length != SizeUint64 {
-		fmt.Println(222)
-		ch <- nil
-		return
+	// size of package can be received in several segments,
+	// partially read size breaks stream
+	length, err := io.ReadFull(conn.ptr, buflen)
+	if err != nil {
+		if length == 0 && isTimeout(err) {
+			return nil, ErrReadTimeout
+		}
+		conn.Close()
+		return nil, ErrReadFailed
 	}
 
+	// body of oversized package is not read,
+	// so stream can not be synchronized again
 	mustLen := PackageT(buflen).BytesToSize()
-	if mustLen > PackSize {
-		fmt.Println(333)
-		ch <- nil
-		return
+	if mustLen > conn.packSize {
+		conn.Close()
+		return nil, ErrReadFailed
 	}
 
-	for {
-		buffer := make([]byte, mustLen-size)
-
-		length, err = conn.ptr.Read(buffer)
-		if err != nil {
-			fmt.Println(444)
-			ch <- nil
-			return
-		}
-
-		pack = bytes.Join(
-			[][]byte{
-				pack,
-				buffer[:length],
-			},
-			[]byte{},
-		)
-
-		size += uint64(length)
-		if size == mustLen {
-			break
-		}
+	// partially read package breaks stream
+	pack := make([]byte, mustLen)
+	if _, err := io.ReadFull(conn.ptr, pack); err != nil {
+		conn.Close()
+		return nil, ErrReadFailed
 	}
 
 	err = json.Unmarshal(pack, msg)
 	if err != nil {
-		fmt.Println(555)
-		ch <- nil
-		return
+		return nil, ErrReadFailed
+	}
+
+	// messages serialized before versioning
+	// have zero version and are of first format
+	if msg.Version() > MsgVersion {
+		return nil, ErrMsgVersion
 	}
 
 	if msg.Network() != NetworkName {
-		fmt.Println(666)
-		ch <- nil
-		return
+		return nil, ErrReadFailed
 	}
 
-	ch <- msg
+	// older formats have no ttl, so message
+	// would not be relayed with zero ttl
+	if msg.Version() < TTLVersion {
+		msg.TTLT = TTLSize
+	}
+
+	return msg, nil
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
 }
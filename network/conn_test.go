@@ -0,0 +1,206 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/number571/go-peer/encoding"
+)
+
+// Connection writing to pipe with reader of messages.
+// Writes are blocked until reader takes them.
+func newTestPipe(t *testing.T) (*ConnT, *ConnT) {
+	local, remote := net.Pipe()
+
+	var (
+		writer = newConn(local, "writer", false)
+		reader = newConn(remote, "reader", true)
+	)
+	t.Cleanup(func() {
+		writer.Close()
+		reader.Close()
+	})
+
+	return writer, reader
+}
+
+// Send queue is blocked by message being written,
+// so following messages wait in queues.
+func blockQueue(t *testing.T, conn *ConnT) {
+	if !conn.enqueue(NewMessage(1, []byte("block")), PriorityHigh) {
+		t.Fatal("message not enqueued")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(conn.queue[PriorityHigh]) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("send queue is not blocked")
+		}
+		time.Sleep(DrainTime)
+	}
+}
+
+func readBody(t *testing.T, conn *ConnT) string {
+	msg := conn.Read()
+	if msg == nil {
+		t.Fatal("message not read")
+	}
+	return string(msg.Body())
+}
+
+func TestConnPriority(t *testing.T) {
+	writer, reader := newTestPipe(t)
+	blockQueue(t, writer)
+
+	writer.enqueue(NewMessage(1, []byte("low")), PriorityLow)
+	writer.enqueue(NewMessage(1, []byte("high")), PriorityHigh)
+
+	for _, body := range []string{"block", "high", "low"} {
+		if got := readBody(t, reader); got != body {
+			t.Fatalf("got %q, expected %q", got, body)
+		}
+	}
+}
+
+func TestConnStarvation(t *testing.T) {
+	writer, reader := newTestPipe(t)
+	blockQueue(t, writer)
+
+	writer.enqueue(NewMessage(1, []byte("low")), PriorityLow)
+	for i := 0; i < 2*StarveSize; i++ {
+		writer.enqueue(NewMessage(1, []byte(fmt.Sprintf("high-%d", i))), PriorityHigh)
+	}
+
+	readBody(t, reader)
+	for i := 0; i <= StarveSize; i++ {
+		if readBody(t, reader) == "low" {
+			return
+		}
+	}
+
+	t.Fatalf("low priority message not written after %d messages", StarveSize)
+}
+
+func TestConnVersion(t *testing.T) {
+	writer, reader := newTestPipe(t)
+
+	newer := NewMessage(1, []byte("newer")).(*MessageT)
+	newer.VersionT = MsgVersion + 1
+
+	legacy := NewMessage(1, []byte("legacy")).(*MessageT)
+	legacy.VersionT = 0
+	legacy.TTLT = 0
+
+	go func() {
+		writer.Write(newer)
+		writer.Write(legacy)
+	}()
+
+	if _, err := reader.readMessage(); err != ErrMsgVersion {
+		t.Fatalf("got error %v, expected %v", err, ErrMsgVersion)
+	}
+
+	// unsupported message does not break stream
+	msg, err := reader.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg.Body()) != "legacy" {
+		t.Fatal("message without version is not read")
+	}
+
+	if msg.TTL() != TTLSize {
+		t.Fatalf("message without ttl has ttl %d, expected %d", msg.TTL(), TTLSize)
+	}
+}
+
+// Failed reads return nil message and error without panic.
+func TestConnReadFailed(t *testing.T) {
+	other := NewMessage(1, nil).(*MessageT)
+	other.NetworkT = "other-network"
+
+	garbage := PackageT("garbage")
+
+	tests := map[string][]byte{
+		"closed":    nil,
+		"garbage":   append(garbage.SizeToBytes(), garbage...),
+		"oversized": encoding.Uint64ToBytes(PackSize + 1),
+		"network":   other.Bytes(),
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			writer, reader := newTestPipe(t)
+
+			go func() {
+				writer.ptr.Write(data)
+				writer.ptr.Close()
+			}()
+
+			msg, err := reader.readMessage()
+			if msg != nil || err != ErrReadFailed {
+				t.Fatalf("got message %v with error %v", msg, err)
+			}
+
+			if reader.Read() != nil {
+				t.Fatal("message read after failure")
+			}
+		})
+	}
+}
+
+func TestConnRequest(t *testing.T) {
+	node, address := newTestNode(t, NodeConfig{})
+	node.Handle(1, func(_ Node, conn Conn, msg Message) {
+		conn.Write(NewResponse(msg, 2, msg.Body()))
+	})
+
+	conn := NewConn(address)
+	if conn == nil {
+		t.Fatal("connection is nil")
+	}
+	defer conn.Close()
+
+	resp := conn.Request(NewMessage(1, []byte("hello")))
+	if resp == nil || string(resp.Body()) != "hello" {
+		t.Fatal("response not received")
+	}
+
+	node.Close()
+	if conn.Request(NewMessage(1, nil)) != nil {
+		t.Fatal("response received from closed node")
+	}
+}
+
+func TestPackage(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("package")} {
+		pack := PackageT(data)
+		if pack.Size() != uint64(len(data)) {
+			t.Fatalf("size is %d, expected %d", pack.Size(), len(data))
+		}
+
+		if size := PackageT(pack.SizeToBytes()).BytesToSize(); size != pack.Size() {
+			t.Fatalf("size from bytes is %d, expected %d", size, pack.Size())
+		}
+	}
+}
+
+// Message is read from several segments.
+func TestConnSegments(t *testing.T) {
+	writer, reader := newTestPipe(t)
+
+	data := NewMessage(1, []byte("segments")).Bytes()
+	go func() {
+		for _, part := range [][]byte{data[:3], data[3:10], data[10:]} {
+			writer.ptr.Write(part)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if got := readBody(t, reader); got != "segments" {
+		t.Fatalf("got %q, expected %q", got, "segments")
+	}
+}
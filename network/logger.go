@@ -0,0 +1,13 @@
+package network
+
+var (
+	_ Logger = &nopLoggerT{}
+)
+
+// Logger used if config has none.
+type nopLoggerT struct{}
+
+func (lg *nopLoggerT) Debug(string, ...interface{}) {}
+func (lg *nopLoggerT) Info(string, ...interface{})  {}
+func (lg *nopLoggerT) Warn(string, ...interface{})  {}
+func (lg *nopLoggerT) Error(string, ...interface{}) {}
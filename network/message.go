@@ -3,31 +3,95 @@ package network
 import (
 	"bytes"
 	"encoding/json"
+	"math"
+	"math/bits"
+	"sync/atomic"
 
 	"github.com/number571/go-peer/crypto"
+	"github.com/number571/go-peer/encoding"
 )
 
 var (
 	_ Message = &MessageT{}
 )
 
+var (
+	nonceCounter uint64
+)
+
 type MessageT struct {
+	VersionT uint8   `json:"version"`
 	HeadT    MsgType `json:"head"`
 	BodyT    []byte  `json:"body"`
 	NonceT   []byte  `json:"nonce"`
 	NetworkT string  `json:"network"`
+	TTLT     uint8   `json:"ttl"`
 }
 
 // Create message with title and data.
 func NewMessage(head MsgType, body []byte) Message {
+	return NewMessageTTL(head, body, TTLSize)
+}
+
+// Create message passing at most ttl hops.
+func NewMessageTTL(head MsgType, body []byte, ttl uint8) Message {
+	return &MessageT{
+		VersionT: MsgVersion,
+		HeadT:    head,
+		BodyT:    body,
+		NonceT:   NewNonce(),
+		NetworkT: NetworkName,
+		TTLT:     ttl,
+	}
+}
+
+// Create message with hash starting with diff zero bits.
+// Nonce is incremented until hash meets difficulty,
+// so nodes can require work to limit spam.
+func NewMessagePoW(head MsgType, body []byte, diff uint8) Message {
+	msg := NewMessage(head, body).(*MessageT)
+
+	seed := encoding.BytesToUint64(msg.NonceT[NonceSize/2:])
+	for !msg.hasWork(diff) {
+		seed++
+		copy(msg.NonceT[NonceSize/2:], encoding.Uint64ToBytes(seed))
+	}
+
+	return msg
+}
+
+// Create response with nonce of request,
+// so client can match it with request.
+func NewResponse(req Message, head MsgType, body []byte) Message {
 	return &MessageT{
+		VersionT: MsgVersion,
 		HeadT:    head,
 		BodyT:    body,
-		NonceT:   crypto.RandBytes(16),
+		NonceT:   req.Nonce(),
 		NetworkT: NetworkName,
+		TTLT:     TTLSize,
 	}
 }
 
+// Nonce is big endian counter with random bytes.
+// Counter makes nonces unique within one process.
+// Random part separates processes: two nodes generate
+// equal nonces with probability 2^(-8*NonceSize/2).
+func NewNonce() []byte {
+	counter := atomic.AddUint64(&nonceCounter, 1)
+	return bytes.Join(
+		[][]byte{
+			encoding.Uint64ToBytes(counter),
+			crypto.RandBytes(NonceSize / 2),
+		},
+		[]byte{},
+	)
+}
+
+func (msg *MessageT) Version() uint8 {
+	return msg.VersionT
+}
+
 func (msg *MessageT) Head() MsgType {
 	return msg.HeadT
 }
@@ -44,8 +108,47 @@ func (msg *MessageT) Network() string {
 	return msg.NetworkT
 }
 
+// Number of hops left for message.
+func (msg *MessageT) TTL() uint8 {
+	return msg.TTLT
+}
+
+// TTL is changed on every hop,
+// so it is not included in hash.
 func (msg *MessageT) Hash() string {
-	return crypto.NewSHA256(msg.Bytes()).String()
+	return msg.newHash().String()
+}
+
+// Number of leading zero bits in hash.
+func (msg *MessageT) Work() uint8 {
+	work := 0
+	for _, b := range msg.newHash().Bytes() {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	if work > math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(work)
+}
+
+func (msg *MessageT) hasWork(diff uint8) bool {
+	return msg.Work() >= diff
+}
+
+func (msg *MessageT) newHash() crypto.Hasher {
+	hmsg := *msg
+	hmsg.TTLT = 0
+	return crypto.NewSHA256(hmsg.Bytes())
+}
+
+func (msg *MessageT) decTTL() {
+	if msg.TTLT == 0 {
+		return
+	}
+	msg.TTLT--
 }
 
 // Serialize with JSON format.
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestMessageNonce(t *testing.T) {
+	const (
+		numWorkers = 8
+		numNonces  = 1000
+	)
+
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		nonces = make(map[string]bool)
+	)
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numNonces; j++ {
+				nonce := string(NewMessage(1, nil).Nonce())
+
+				mtx.Lock()
+				if nonces[nonce] {
+					t.Error("nonce is repeated")
+				}
+				nonces[nonce] = true
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(nonces) != numWorkers*numNonces {
+		t.Fatalf("got %d nonces, expected %d", len(nonces), numWorkers*numNonces)
+	}
+}
+
+func TestNewNonce(t *testing.T) {
+	prev := NewNonce()
+	for i := 0; i < 100; i++ {
+		nonce := NewNonce()
+		if len(nonce) != NonceSize {
+			t.Fatalf("got nonce of %d bytes, expected %d", len(nonce), NonceSize)
+		}
+
+		// counter part is increasing
+		if bytes.Compare(nonce[:NonceSize/2], prev[:NonceSize/2]) <= 0 {
+			t.Fatal("counter of nonce is not increasing")
+		}
+		prev = nonce
+	}
+}
+
+func TestMessagePoW(t *testing.T) {
+	for _, diff := range []uint8{0, 4, 12} {
+		msg := NewMessagePoW(1, []byte("body"), diff)
+		if msg.Work() < diff {
+			t.Fatalf("message has work %d, expected %d", msg.Work(), diff)
+		}
+
+		if string(msg.Body()) != "body" {
+			t.Fatal("body of message is changed")
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package network
 
 import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/number571/go-peer/crypto"
 )
@@ -11,23 +18,118 @@ var (
 	_ Node = &NodeT{}
 )
 
+var (
+	ErrNotConnected = errors.New("network: connection not found")
+	ErrQueueFull    = errors.New("network: send queue is full")
+)
+
 // Basic structure for network use.
 type NodeT struct {
 	mainMtx  sync.Mutex
 	routeMtx sync.Mutex
 
-	mapping      map[string]bool
+	closed       bool
+	done         chan struct{}
+	id           string
+	moniker      string
+	config       NodeConfig
+	mapping      map[string]*list.Element
+	mappingList  *list.List
+	listeners    map[net.Listener]bool
 	connections  map[string]Conn
+	clients      map[string]*ConnT
+	accepted     map[string]*ConnT
+	dialed       map[string]time.Time
+	discovery    map[string]int
+	bans         map[string]time.Time
 	handleRoutes map[MsgType]HandleFunc
+	handleDef    HandleFunc
+	handleRoles  map[byte]RoleFunc
+	handleAnom   AnomalyFunc
+	onConnect    ConnFunc
+	onDisconnect ConnFunc
+	stats        statsT
 }
 
-// Create client by private key as identification.
-func NewNode() Node {
-	return &NodeT{
-		mapping:      make(map[string]bool),
+// Create node with moniker as identification.
+func NewNode(moniker string) Node {
+	return NewNodeWithConfig(moniker, NodeConfig{})
+}
+
+// Create node with limits from config.
+// Zero fields of config are set to default values.
+func NewNodeWithConfig(moniker string, cfg NodeConfig) Node {
+	if cfg.MaxConns == 0 {
+		cfg.MaxConns = ConnSize
+	}
+	if cfg.MappingSize == 0 {
+		cfg.MappingSize = MappSize
+	}
+	if cfg.RetryLimit == 0 {
+		cfg.RetryLimit = RetrySize
+	}
+	if cfg.MaxMsgSize == 0 {
+		cfg.MaxMsgSize = PackSize
+	}
+	if cfg.RateLimit != 0 && cfg.RateBurst == 0 {
+		cfg.RateBurst = 1
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = &nopLoggerT{}
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DialTime
+	}
+	if cfg.RedialBase == 0 {
+		cfg.RedialBase = RedialBase
+	}
+	if cfg.RedialMax == 0 {
+		cfg.RedialMax = RedialMax
+	}
+	if cfg.BanTime == 0 {
+		cfg.BanTime = BanTime
+	}
+
+	node := &NodeT{
+		done:         make(chan struct{}),
+		id:           crypto.RandString(NonceSize),
+		moniker:      moniker,
+		config:       cfg,
+		mapping:      make(map[string]*list.Element),
+		mappingList:  list.New(),
+		listeners:    make(map[net.Listener]bool),
 		connections:  make(map[string]Conn),
+		clients:      make(map[string]*ConnT),
+		accepted:     make(map[string]*ConnT),
+		dialed:       make(map[string]time.Time),
+		discovery:    make(map[string]int),
+		bans:         make(map[string]time.Time),
 		handleRoutes: make(map[MsgType]HandleFunc),
+		handleRoles:  make(map[byte]RoleFunc),
 	}
+
+	node.handleRoles[IsNode] = roleNode
+	node.handleRoles[IsClient] = roleClient
+
+	node.handleRoutes[MsgGetPeers] = handleGetPeers
+	node.handleRoutes[MsgSetPeers] = handleSetPeers
+
+	return node
+}
+
+// Name of node sent to peers in handshake.
+func (node *NodeT) Moniker() string {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	return node.moniker
+}
+
+func (node *NodeT) SetMoniker(moniker string) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.moniker = moniker
 }
 
 func (node *NodeT) Mutex() *sync.Mutex {
@@ -35,53 +137,195 @@ func (node *NodeT) Mutex() *sync.Mutex {
 }
 
 func (node *NodeT) Broadcast(msg Message) {
+	node.BroadcastPriority(msg, PriorityNormal)
+}
+
+// Broadcast message which is written before messages of lower priority.
+func (node *NodeT) BroadcastPriority(msg Message, prio Priority) {
+	node.broadcast(nil, msg, prio)
+}
+
+// Broadcast message to all connections except one.
+// Used to relay message without sending it back to origin.
+func (node *NodeT) BroadcastExcept(except Conn, msg Message) {
+	node.broadcast(except, msg, PriorityNormal)
+}
+
+// Message without hops left is not sent.
+func (node *NodeT) broadcast(except Conn, msg Message, prio Priority) {
+	if node.isClosed() {
+		return
+	}
+
 	node.setMapping(msg.Hash())
+	if msg.TTL() == 0 {
+		return
+	}
+	atomic.AddUint64(&node.stats.messagesBroadcast, 1)
 
 	for _, conn := range node.Connections() {
-		go conn.Write(msg)
+		if conn == except {
+			continue
+		}
+		conn.(*ConnT).enqueue(msg, prio)
+	}
+}
+
+// Send message to one connection through its send queue.
+func (node *NodeT) Send(conn Conn, msg Message) error {
+	iconn, ok := conn.(*ConnT)
+	if !ok || !node.hasConnection(iconn) {
+		return ErrNotConnected
 	}
+
+	node.setMapping(msg.Hash())
+
+	if !iconn.enqueue(msg, PriorityNormal) {
+		return ErrQueueFull
+	}
+
+	return nil
 }
 
 // Turn on listener by address.
 // Client handle function need be not null.
 func (node *NodeT) Listen(address string) error {
-	listen, err := net.Listen("tcp", address)
+	return node.ListenContext(context.Background(), address)
+}
+
+// Turn on listener by address until context is done.
+// Connections accepted by listener are closed with context.
+func (node *NodeT) ListenContext(ctx context.Context, address string) error {
+	listen, err := node.listen(address)
 	if err != nil {
 		return err
 	}
-	defer listen.Close()
+
+	return node.serve(ctx, listen)
+}
+
+// Run accept loop on created listener.
+// Listener is closed when loop ends.
+func (node *NodeT) Serve(listen net.Listener) error {
+	return node.serve(context.Background(), listen)
+}
+
+func (node *NodeT) serve(ctx context.Context, listen net.Listener) error {
+	if !node.setListener(listen) {
+		listen.Close()
+		return nil
+	}
+	defer node.delListener(listen)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			listen.Close()
+		case <-done:
+		}
+	}()
 
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			break
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if node.isClosed() {
+				return nil
+			}
+			node.log().Error("accept failed", "error", err)
+			return err
 		}
 
-		if node.hasMaxConnSize() {
+		if node.IsBanned(conn.RemoteAddr().String()) {
+			node.log().Debug("connection rejected, host is banned", "address", conn.RemoteAddr().String())
 			conn.Close()
 			continue
 		}
 
-		var (
-			iconn = &ConnT{crypto.RandString(16), conn}
-			whoIs = make([]byte, 1)
-		)
-		conn.Read(whoIs)
-
-		switch whoIs[0] {
-		case IsNode:
-			node.setConnection(iconn)
-		case IsClient:
-			// do nothing
-		default:
+		if node.hasMaxConnSize() {
+			node.log().Warn("connection rejected, node is full", "address", conn.RemoteAddr().String())
 			conn.Close()
 			continue
 		}
 
-		go node.handleConn(iconn)
+		iconn := newConn(node.counted(conn), conn.RemoteAddr().String(), true)
+		node.setLimits(iconn)
+		go node.acceptConn(ctx, iconn)
 	}
+}
 
-	return nil
+// Read role of accepted connection and handle it.
+// Connection is closed with node until handshake is done,
+// or until it is handled if role does not add it.
+func (node *NodeT) acceptConn(ctx context.Context, conn *ConnT) {
+	if !node.setAccepted(conn) {
+		conn.Close()
+		return
+	}
+
+	// handshake of TLS is done on first read,
+	// so silent peer is dropped by deadline
+	conn.setReadDeadline()
+
+	whoIs := make([]byte, 1)
+	if _, err := io.ReadFull(conn.ptr, whoIs); err != nil {
+		node.delAccepted(conn)
+		node.log().Warn("handshake failed", "address", conn.address, "error", err)
+		conn.Close()
+		return
+	}
+
+	f, ok := node.getRole(whoIs[0])
+	if !ok || !f(node, conn) {
+		node.delAccepted(conn)
+		node.log().Warn("handshake failed", "address", conn.address, "role", whoIs[0])
+		conn.Close()
+		return
+	}
+
+	// connection of custom role can be not added
+	// as node or client, so it is closed with node
+	if node.isTracked(conn) {
+		node.delAccepted(conn)
+	} else {
+		defer node.delAccepted(conn)
+	}
+
+	node.handleConn(ctx, conn)
+}
+
+// Stop listeners, drain and close all connections.
+// Can be called repeatedly, only first call takes effect.
+func (node *NodeT) Close() error {
+	node.mainMtx.Lock()
+	if node.closed {
+		node.mainMtx.Unlock()
+		return nil
+	}
+	node.closed = true
+	close(node.done)
+
+	var err error
+	for listen := range node.listeners {
+		if e := listen.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, conn := range node.clients {
+		conn.Close()
+	}
+	for _, conn := range node.accepted {
+		conn.Close()
+	}
+	node.mainMtx.Unlock()
+
+	node.DrainAll(TimeSize * time.Second)
+	return err
 }
 
 // Add function to mapping for route use.
@@ -90,30 +334,169 @@ func (node *NodeT) Handle(tmsg MsgType, handle HandleFunc) Node {
 	return node
 }
 
-func (node *NodeT) handleConn(conn *ConnT) {
+// Remove function from mapping.
+// Messages of type are passed to default function.
+func (node *NodeT) RemoveHandle(tmsg MsgType) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	delete(node.handleRoutes, tmsg)
+	return node
+}
+
+// Get list of message types with routes.
+func (node *NodeT) Handlers() []MsgType {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	var list []MsgType
+	for tmsg := range node.handleRoutes {
+		list = append(list, tmsg)
+	}
+
+	return list
+}
+
+// Set function called for messages of types without route.
+// Without it such messages are ignored.
+func (node *NodeT) HandleDefault(handle HandleFunc) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.handleDef = handle
+	return node
+}
+
+// Add function called for connections announced with role.
+// Connection is closed if function returns false.
+func (node *NodeT) HandleRole(role byte, handle RoleFunc) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.handleRoles[role] = handle
+	return node
+}
+
+// Set function called when node connection is added.
+func (node *NodeT) OnConnect(handle ConnFunc) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.onConnect = handle
+	return node
+}
+
+// Set function called when node connection is removed.
+func (node *NodeT) OnDisconnect(handle ConnFunc) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.onDisconnect = handle
+	return node
+}
+
+// Set function called for dropped or invalid messages.
+func (node *NodeT) HandleAnomaly(handle AnomalyFunc) Node {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	node.handleAnom = handle
+	return node
+}
+
+func (node *NodeT) handleConn(ctx context.Context, conn *ConnT) {
 	defer func() {
 		node.delConnection(conn)
+		node.delClient(conn)
+		node.log().Info("connection dropped", "address", conn.address, "moniker", conn.moniker)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-conn.closed:
+		}
+	}()
+
+	var (
+		limit   = node.config.RetryLimit
+		counter = uint(0) // failures of peer
+		idle    = uint(0) // reads without data
+	)
+
+	// peer repeating failures is not accepted again,
+	// quiet peer is only disconnected
+	defer func() {
+		if counter == limit {
+			node.Ban(conn.banAddress(), node.config.BanTime)
+		}
 	}()
 
-	counter := 0
+	for counter != limit && idle != limit {
+		msg, err := conn.readMessage()
+		if conn.isClosed() {
+			return
+		}
+
+		if err == ErrReadTimeout {
+			node.anomaly(conn, AnomalyIdle)
+			idle++
+			continue
+		}
+		idle = 0
+
+		// peer can use formats unknown to node
+		if err == ErrMsgVersion {
+			node.anomaly(conn, AnomalyVersion)
+			continue
+		}
+
+		if err != nil {
+			node.anomaly(conn, AnomalyRead)
+			counter++
+			continue
+		}
+		conn.seen()
+
+		// messages above limit are dropped, flood of them
+		// breaks connection even if other messages pass
+		if node.config.RateLimit != 0 && !conn.allow(node.config.RateLimit, node.config.RateBurst) {
+			node.anomaly(conn, AnomalyRate)
+			if conn.flooded(limit) {
+				// peer is banned as for failures
+				counter = limit
+			}
+			continue
+		}
 
-	for counter != RetrySize {
-		msg := conn.Read()
-		if msg == nil {
+		// only responses to own discovery are not mined
+		if msg.Work() < node.config.MinWork && !node.isDiscovery(msg) {
+			node.anomaly(conn, AnomalyWork)
 			counter++
 			continue
 		}
 
 		hash := msg.Hash()
+		// relayed duplicates are normal in mesh,
+		// so they are dropped without counting
 		if node.inMapping(hash) {
-			counter++
+			atomic.AddUint64(&node.stats.messagesDeduped, 1)
+			node.anomaly(conn, AnomalyReplay)
 			continue
 		}
 		node.setMapping(hash)
 
-		ok := node.handleFunc(conn, msg)
-		if !ok {
-			counter++
+		if imsg, ok := msg.(*MessageT); ok {
+			imsg.decTTL()
+		}
+
+		if anom := node.handleFunc(conn, msg); anom != 0 {
+			node.anomaly(conn, anom)
+			// peer can use types unknown to node
+			if anom != AnomalyRoute {
+				counter++
+			}
 			continue
 		}
 
@@ -121,17 +504,41 @@ func (node *NodeT) handleConn(conn *ConnT) {
 	}
 }
 
-func (node *NodeT) handleFunc(conn Conn, msg Message) bool {
+// Returns zero if message was handled.
+// Message without route is passed to default function.
+// Panic in handle function is recovered and
+// counted as failure of connection.
+func (node *NodeT) handleFunc(conn Conn, msg Message) (anom Anomaly) {
 	node.routeMtx.Lock()
 	defer node.routeMtx.Unlock()
 
 	f, ok := node.getFunction(msg.Head())
 	if !ok {
-		return false
+		return AnomalyRoute
 	}
 
+	defer func() {
+		if err := recover(); err != nil {
+			node.log().Error("handler panicked", "head", msg.Head(), "error", err)
+			atomic.AddUint64(&node.stats.handlerErrors, 1)
+			anom = AnomalyPanic
+		}
+	}()
+
 	f(node, conn, msg)
-	return true
+	return 0
+}
+
+func (node *NodeT) anomaly(conn Conn, anom Anomaly) {
+	node.mainMtx.Lock()
+	f := node.handleAnom
+	node.mainMtx.Unlock()
+
+	if f == nil {
+		return
+	}
+
+	f(node, conn, anom)
 }
 
 // Get list of connection addresses.
@@ -147,30 +554,309 @@ func (node *NodeT) Connections() []Conn {
 	return list
 }
 
+// Get addresses of connected peers.
+// Inbound peers are listed by their advertised listen address.
+func (node *NodeT) Peers() []string {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	var list []string
+	for _, conn := range node.connections {
+		list = append(list, conn.(*ConnT).peerAddress())
+	}
+
+	return list
+}
+
+// Get info about connected peers and dialed peers that are down.
+func (node *NodeT) KnownPeers() []PeerInfo {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	var (
+		list      []PeerInfo
+		connected = make(map[string]bool)
+	)
+
+	for _, conn := range node.connections {
+		iconn := conn.(*ConnT)
+		connected[iconn.address] = true
+		list = append(list, PeerInfo{
+			Address:   iconn.address,
+			Inbound:   iconn.inbound,
+			Connected: true,
+			LastSeen:  iconn.LastSeen(),
+		})
+	}
+
+	for address, lastSeen := range node.dialed {
+		if connected[address] {
+			continue
+		}
+		list = append(list, PeerInfo{
+			Address:  address,
+			LastSeen: lastSeen,
+		})
+	}
+
+	return list
+}
+
+// Number of used and max connections.
+func (node *NodeT) Capacity() (int, int) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	return len(node.connections), int(node.config.MaxConns)
+}
+
+// Refuse connections with peer address until time passes.
+// Address without port bans every port of host.
+// Current connections with address are closed.
+func (node *NodeT) Ban(address string, duration time.Duration) {
+	address = banAddress(address)
+
+	node.mainMtx.Lock()
+	node.bans[address] = time.Now().Add(duration)
+
+	conns := make([]*ConnT, 0, len(node.connections))
+	for _, conn := range node.connections {
+		conns = append(conns, conn.(*ConnT))
+	}
+	node.mainMtx.Unlock()
+
+	node.log().Warn("address banned", "address", address, "duration", duration)
+
+	// addresses are resolved without lock, ban of host
+	// closes only inbound connections from it
+	for _, conn := range conns {
+		if banAddress(conn.peerAddress()) == address ||
+			(conn.inbound && hostOf(conn.address) == address) {
+			node.delConnection(conn)
+		}
+	}
+}
+
+func (node *NodeT) Unban(address string) {
+	address = banAddress(address)
+
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	delete(node.bans, address)
+}
+
+// Address is banned itself or by its host.
+func (node *NodeT) IsBanned(address string) bool {
+	address = banAddress(address)
+
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	if node.isBanned(address) {
+		return true
+	}
+
+	host := hostOf(address)
+	return host != "" && node.isBanned(host)
+}
+
+// Expired ban is removed on check.
+func (node *NodeT) isBanned(address string) bool {
+	until, ok := node.bans[address]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(node.bans, address)
+		return false
+	}
+
+	return true
+}
+
+// Address with port is set in the form used by connect,
+// address without port is set as IP of host.
+func banAddress(address string) string {
+	if addr, err := net.ResolveTCPAddr("tcp", address); err == nil {
+		return addr.String()
+	}
+	if addr, err := net.ResolveIPAddr("ip", address); err == nil {
+		return addr.String()
+	}
+	return address
+}
+
+// Returns empty string if address has no port.
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
 // Connect to node by address.
 // Client handle function need be not null.
 func (node *NodeT) Connect(address string) Conn {
-	if node.hasMaxConnSize() {
+	return node.ConnectContext(context.Background(), address)
+}
+
+// Connect to node by address until context is done.
+// Dial and handshake are also limited by connect timeout.
+func (node *NodeT) ConnectContext(ctx context.Context, address string) Conn {
+	return node.connect(ctx, address, false)
+}
+
+// Keep connection to node by address.
+// Address is dialed again with exponential backoff
+// after every disconnect until node is closed.
+func (node *NodeT) ConnectPersistent(address string) {
+	go func() {
+		delay := node.config.RedialBase
+
+		for !node.isClosed() {
+			conn := node.connect(context.Background(), address, true)
+			if conn != nil {
+				// peer closing connection right after
+				// handshake is redialed with backoff too
+				start := time.Now()
+				<-conn.(*ConnT).closed
+				if time.Since(start) >= StableTime {
+					delay = node.config.RedialBase
+				}
+			}
+
+			select {
+			case <-node.done:
+				return
+			case <-time.After(delay):
+			}
+
+			delay *= 2
+			if delay > node.config.RedialMax {
+				delay = node.config.RedialMax
+			}
+		}
+	}()
+}
+
+// Persistent connections are not limited by max connections,
+// so inbound connections can not starve them.
+func (node *NodeT) connect(ctx context.Context, address string, persistent bool) Conn {
+	// localhost:8000 and 127.0.0.1:8000 are the same peer
+	if addr, err := net.ResolveTCPAddr("tcp", address); err == nil {
+		address = addr.String()
+	}
+
+	if conn := node.getOutbound(address); conn != nil {
+		return conn
+	}
+
+	if node.IsBanned(address) {
+		return nil
+	}
+
+	if !persistent && node.hasMaxConnSize() {
+		return nil
+	}
+
+	if node.isClosed() {
 		return nil
 	}
 
-	conn, err := net.Dial("tcp", address)
+	ctx, cancel := context.WithTimeout(ctx, node.config.ConnectTimeout)
+	defer cancel()
+
+	conn, err := node.dial(ctx, address)
 	if err != nil {
+		node.log().Debug("dial failed", "address", address, "error", err)
 		return nil
 	}
 
+	conn = node.counted(conn)
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
 	conn.Write([]byte{IsNode})
 
-	iconn := &ConnT{crypto.RandString(16), conn}
+	iconn := newConn(conn, address, false)
+	iconn.persistent = persistent
+	node.setLimits(iconn)
+	iconn.writeHandshake(node.id, node.Moniker(), node.listenAddress())
 
-	node.setConnection(iconn)
-	go node.handleConn(iconn)
+	if !iconn.readHandshake() {
+		node.log().Warn("handshake failed", "address", address)
+		iconn.Close()
+		return nil
+	}
+	conn.SetDeadline(time.Time{})
+
+	if !node.setConnection(iconn) {
+		iconn.Close()
+		if conn := node.getOutbound(address); conn != nil {
+			return conn
+		}
+		if conn := node.getID(iconn.id); conn != nil {
+			return conn
+		}
+		return nil
+	}
+	go node.handleConn(context.Background(), iconn)
 
 	return iconn
 }
 
+// Connections are encrypted if config has TLS.
+func (node *NodeT) dial(ctx context.Context, address string) (net.Conn, error) {
+	if node.config.TLSConfig != nil {
+		dialer := &tls.Dialer{Config: node.config.TLSConfig}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+func (node *NodeT) listen(address string) (net.Listener, error) {
+	if node.config.TLSConfig != nil {
+		return tls.Listen("tcp", address, node.config.TLSConfig)
+	}
+	return net.Listen("tcp", address)
+}
+
 func (node *NodeT) Disconnect(conn Conn) {
-	node.delConnection(conn.(*ConnT))
+	iconn, ok := conn.(*ConnT)
+	if !ok {
+		return
+	}
+	node.delConnection(iconn)
+}
+
+// Wait for pending writes of connection and close it.
+// Connection is closed even if timeout expired.
+func (node *NodeT) Drain(conn Conn, timeout time.Duration) bool {
+	iconn, ok := conn.(*ConnT)
+	if !ok {
+		return false
+	}
+	ok = iconn.drain(timeout)
+	node.delConnection(iconn)
+	return ok
+}
+
+// Drain all connections and close them.
+func (node *NodeT) DrainAll(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, conn := range node.Connections() {
+		wg.Add(1)
+		go func(conn Conn) {
+			defer wg.Done()
+			node.Drain(conn, timeout)
+		}(conn)
+	}
+	wg.Wait()
 }
 
 func (node *NodeT) setFunction(tmsg MsgType, handle HandleFunc) {
@@ -185,29 +871,280 @@ func (node *NodeT) getFunction(tmsg MsgType) (HandleFunc, bool) {
 	defer node.mainMtx.Unlock()
 
 	f, ok := node.handleRoutes[tmsg]
+	if !ok && node.handleDef != nil {
+		return node.handleDef, true
+	}
+	return f, ok
+}
+
+func (node *NodeT) getRole(role byte) (RoleFunc, bool) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	f, ok := node.handleRoles[role]
 	return f, ok
 }
 
+// Exchange monikers and listen addresses and add connection.
+func roleNode(node Node, conn Conn) bool {
+	var (
+		inode = node.(*NodeT)
+		iconn = conn.(*ConnT)
+	)
+
+	if !iconn.readHandshake() {
+		return false
+	}
+
+	if iconn.listen != "" && inode.IsBanned(iconn.peerAddress()) {
+		return false
+	}
+	iconn.writeHandshake(inode.id, inode.Moniker(), inode.listenAddress())
+
+	return inode.setConnection(iconn)
+}
+
+func roleClient(node Node, conn Conn) bool {
+	return node.(*NodeT).setClient(conn.(*ConnT))
+}
+
+func (node *NodeT) setClient(conn *ConnT) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	if node.closed {
+		return false
+	}
+
+	node.clients[conn.nonce] = conn
+	return true
+}
+
+func (node *NodeT) delClient(conn *ConnT) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	delete(node.clients, conn.nonce)
+}
+
+func (node *NodeT) setAccepted(conn *ConnT) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	if node.closed {
+		return false
+	}
+
+	node.accepted[conn.nonce] = conn
+	return true
+}
+
+func (node *NodeT) delAccepted(conn *ConnT) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	delete(node.accepted, conn.nonce)
+}
+
+// Connection is added as node or client.
+func (node *NodeT) isTracked(conn *ConnT) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	_, inConns := node.connections[conn.nonce]
+	_, inClients := node.clients[conn.nonce]
+	return inConns || inClients
+}
+
+func (node *NodeT) setLimits(conn *ConnT) {
+	conn.packSize = node.config.MaxMsgSize
+	conn.readTime = node.config.ReadTimeout
+	conn.sendTime = node.config.WriteTimeout
+}
+
+// Config is not changed after creation of node.
+func (node *NodeT) log() Logger {
+	return node.config.Logger
+}
+
+func (node *NodeT) isClosed() bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	return node.closed
+}
+
+func (node *NodeT) setListener(listen net.Listener) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	if node.closed {
+		return false
+	}
+
+	node.listeners[listen] = true
+	return true
+}
+
+// Address of first active listener.
+func (node *NodeT) listenAddress() string {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	for listen := range node.listeners {
+		return listen.Addr().String()
+	}
+	return ""
+}
+
+func (node *NodeT) delListener(listen net.Listener) {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	delete(node.listeners, listen)
+	listen.Close()
+}
+
 func (node *NodeT) hasMaxConnSize() bool {
 	node.mainMtx.Lock()
 	defer node.mainMtx.Unlock()
 
-	return len(node.connections) > ConnSize
+	return uint(len(node.connections)) >= node.config.MaxConns
+}
+
+func (node *NodeT) getOutbound(address string) *ConnT {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	return node.findOutbound(address)
+}
+
+func (node *NodeT) findOutbound(address string) *ConnT {
+	for _, conn := range node.connections {
+		iconn := conn.(*ConnT)
+		if !iconn.inbound && iconn.address == address {
+			return iconn
+		}
+	}
+	return nil
+}
+
+// Connection to node with identifier from handshake.
+// Identifier is random for every node, unlike moniker
+// which is only a display name. Own identifier is not compared.
+func (node *NodeT) findID(id string) *ConnT {
+	if id == "" || id == node.id {
+		return nil
+	}
+
+	for _, conn := range node.connections {
+		iconn := conn.(*ConnT)
+		if iconn.id == id {
+			return iconn
+		}
+	}
+	return nil
+}
+
+// Connection initiated by node with lower identifier is kept.
+func (node *NodeT) preferred(conn *ConnT) bool {
+	if conn.inbound {
+		return conn.id < node.id
+	}
+	return node.id < conn.id
+}
+
+func (node *NodeT) getID(id string) *ConnT {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	return node.findID(id)
+}
+
+func (node *NodeT) hasConnection(conn *ConnT) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	_, ok := node.connections[conn.nonce]
+	return ok
+}
+
+// Logger can read state of node,
+// so it is called without lock.
+func (node *NodeT) setConnection(conn *ConnT) bool {
+	if !node.addConnection(conn) {
+		return false
+	}
+
+	node.log().Info("connection added", "address", conn.address, "moniker", conn.moniker)
+	return true
 }
 
-func (node *NodeT) setConnection(conn *ConnT) {
+func (node *NodeT) addConnection(conn *ConnT) bool {
 	node.mainMtx.Lock()
 	defer node.mainMtx.Unlock()
 
+	if node.closed {
+		return false
+	}
+
+	// nodes dialed each other at the same time,
+	// both sides keep the same one of connections,
+	// second connection in one direction is rejected
+	if dup := node.findID(conn.id); dup != nil {
+		if dup.inbound == conn.inbound || !node.preferred(conn) {
+			return false
+		}
+		node.removeConnection(dup)
+	}
+
+	// limit is checked again under the same lock,
+	// so simultaneous connections can not exceed it
+	if !conn.persistent && uint(len(node.connections)) >= node.config.MaxConns {
+		return false
+	}
+
+	if !conn.inbound && node.findOutbound(conn.address) != nil {
+		return false
+	}
+
+	if !conn.inbound {
+		node.dialed[conn.address] = conn.LastSeen()
+	}
+
 	node.connections[conn.nonce] = conn
+	atomic.AddUint64(&node.stats.totalConnections, 1)
+	if node.onConnect != nil {
+		go node.onConnect(node, conn)
+	}
+
+	return true
 }
 
 func (node *NodeT) delConnection(conn *ConnT) {
 	node.mainMtx.Lock()
 	defer node.mainMtx.Unlock()
 
+	node.removeConnection(conn)
+}
+
+func (node *NodeT) removeConnection(conn *ConnT) {
+	defer conn.Close()
+
+	// connection can be deleted by handler and by
+	// disconnect, callback is called only once
+	if _, ok := node.connections[conn.nonce]; !ok {
+		return
+	}
+
+	if !conn.inbound {
+		node.dialed[conn.address] = conn.LastSeen()
+	}
+
 	delete(node.connections, conn.nonce)
-	conn.Close()
+	if node.onDisconnect != nil {
+		go node.onDisconnect(node, conn)
+	}
 }
 
 func (node *NodeT) inMapping(hash string) bool {
@@ -218,16 +1155,30 @@ func (node *NodeT) inMapping(hash string) bool {
 	return ok
 }
 
+// Hashes are evicted in order of last setting,
+// so recently seen hash is not evicted before stale ones.
 func (node *NodeT) setMapping(hash string) {
 	node.mainMtx.Lock()
-	defer node.mainMtx.Unlock()
 
-	if uint(len(node.mapping)) > MappSize {
-		for k := range node.mapping {
-			delete(node.mapping, k)
-			break
-		}
+	if elem, ok := node.mapping[hash]; ok {
+		node.mappingList.MoveToBack(elem)
+		node.mainMtx.Unlock()
+		return
+	}
+
+	var evicted []string
+	for uint(len(node.mapping)) >= node.config.MappingSize {
+		oldest := node.mappingList.Front()
+		delete(node.mapping, oldest.Value.(string))
+		node.mappingList.Remove(oldest)
+		evicted = append(evicted, oldest.Value.(string))
 	}
 
-	node.mapping[hash] = true
+	node.mapping[hash] = node.mappingList.PushBack(hash)
+	node.mainMtx.Unlock()
+
+	// logger can read state of node
+	for _, hash := range evicted {
+		node.log().Debug("hash evicted", "hash", hash)
+	}
 }
@@ -0,0 +1,1523 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/number571/go-peer/encoding"
+)
+
+// Node serving on random loopback port.
+func newTestNode(t *testing.T, cfg NodeConfig) (*NodeT, string) {
+	node := NewNodeWithConfig("test", cfg).(*NodeT)
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Serve(listen)
+	t.Cleanup(func() { node.Close() })
+
+	waitFor(t, func() bool { return node.listenAddress() != "" })
+	return node, listen.Addr().String()
+}
+
+// Two nodes with connection from first to second.
+func newTestPair(t *testing.T, cfg NodeConfig) (*NodeT, *NodeT, Conn) {
+	node1, _ := newTestNode(t, cfg)
+	node2, address := newTestNode(t, cfg)
+
+	conn := node1.Connect(address)
+	if conn == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(node2.Connections()) == 1 })
+
+	return node1, node2, conn
+}
+
+// Connection to node with handshake done,
+// messages received from node are not read.
+func dialTestConn(t *testing.T, address string) *ConnT {
+	ptr, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr.Write([]byte{IsNode})
+
+	conn := newConn(ptr, address, false)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.writeHandshake(conn.nonce, "raw", "")
+	if !conn.readHandshake() {
+		t.Fatal("handshake failed")
+	}
+
+	return conn
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(TimeSize * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(DrainTime)
+	}
+}
+
+func TestNodeMaxConns(t *testing.T) {
+	const (
+		maxConns = 4
+		numPeers = 32
+	)
+
+	node, address := newTestNode(t, NodeConfig{MaxConns: maxConns})
+
+	var (
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+		exceeded = make(chan int, 1)
+	)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if used, _ := node.Capacity(); used > maxConns {
+				exceeded <- used
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < numPeers; i++ {
+		peer := NewNode("peer")
+		t.Cleanup(func() { peer.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.Connect(address)
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	select {
+	case used := <-exceeded:
+		t.Fatalf("node has %d connections, max is %d", used, maxConns)
+	default:
+	}
+
+	if used, _ := node.Capacity(); used != maxConns {
+		t.Fatalf("node has %d connections, expected %d", used, maxConns)
+	}
+
+	// closed connection frees slot for new peer
+	node.Disconnect(node.Connections()[0])
+	waitFor(t, func() bool {
+		used, _ := node.Capacity()
+		return used == maxConns-1
+	})
+
+	peer := NewNode("peer")
+	defer peer.Close()
+
+	if peer.Connect(address) == nil {
+		t.Fatal("peer not accepted after slot was freed")
+	}
+
+	if used, _ := node.Capacity(); used != maxConns {
+		t.Fatalf("node has %d connections, expected %d", used, maxConns)
+	}
+
+	other := NewNode("other")
+	defer other.Close()
+
+	if other.Connect(address) != nil {
+		t.Fatal("peer accepted over limit")
+	}
+}
+
+func TestNodeMapping(t *testing.T) {
+	const (
+		mappingSize = 4
+	)
+
+	node := NewNodeWithConfig("test", NodeConfig{MappingSize: mappingSize}).(*NodeT)
+	defer node.Close()
+
+	for i := 0; i <= mappingSize; i++ {
+		node.setMapping(fmt.Sprintf("hash-%d", i))
+	}
+
+	if len(node.mapping) != mappingSize || node.mappingList.Len() != mappingSize {
+		t.Fatalf("mapping has %d hashes, expected %d", len(node.mapping), mappingSize)
+	}
+
+	if node.inMapping("hash-0") {
+		t.Fatal("first hash is not evicted")
+	}
+
+	for i := 1; i <= mappingSize; i++ {
+		if !node.inMapping(fmt.Sprintf("hash-%d", i)) {
+			t.Fatalf("hash %d is evicted", i)
+		}
+	}
+
+	// setting again makes hash recent
+	node.setMapping("hash-1")
+	node.setMapping("hash-new")
+
+	if !node.inMapping("hash-1") {
+		t.Fatal("recent hash is evicted")
+	}
+
+	if node.inMapping("hash-2") {
+		t.Fatal("oldest hash is not evicted")
+	}
+}
+
+func TestNodeCallbacks(t *testing.T) {
+	var (
+		connects    int32
+		disconnects int32
+	)
+
+	node, address := newTestNode(t, NodeConfig{})
+	node.OnConnect(func(Node, Conn) { atomic.AddInt32(&connects, 1) })
+	node.OnDisconnect(func(Node, Conn) { atomic.AddInt32(&disconnects, 1) })
+
+	peer := NewNode("peer")
+	defer peer.Close()
+
+	if peer.Connect(address) == nil {
+		t.Fatal("peer not connected")
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&connects) == 1 })
+
+	// connection is removed by disconnect and by
+	// reading goroutine seeing it closed
+	conn := node.Connections()[0]
+	node.Disconnect(conn)
+	node.Disconnect(conn)
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&disconnects) == 1 })
+	waitFor(t, func() bool { return len(peer.Connections()) == 0 })
+	time.Sleep(100 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Fatalf("connect called %d times, expected 1", n)
+	}
+
+	if n := atomic.LoadInt32(&disconnects); n != 1 {
+		t.Fatalf("disconnect called %d times, expected 1", n)
+	}
+}
+
+func TestNodeSimultaneousConnect(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		node1, address1 := newTestNode(t, NodeConfig{})
+		node2, address2 := newTestNode(t, NodeConfig{})
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			node1.Connect(address2)
+		}()
+		go func() {
+			defer wg.Done()
+			node2.Connect(address1)
+		}()
+		wg.Wait()
+
+		// rejected duplicates are closed asynchronously
+		time.Sleep(100 * time.Millisecond)
+
+		conns1, conns2 := node1.Connections(), node2.Connections()
+		if len(conns1) != 1 || len(conns2) != 1 {
+			t.Fatalf("nodes have %d and %d connections, expected 1", len(conns1), len(conns2))
+		}
+
+		var (
+			conn1 = conns1[0].(*ConnT)
+			conn2 = conns2[0].(*ConnT)
+		)
+
+		if conn1.id != node2.id || conn2.id != node1.id {
+			t.Fatal("connections are not to each other")
+		}
+
+		if conn1.inbound == conn2.inbound {
+			t.Fatal("nodes kept different connections")
+		}
+
+		node1.Close()
+		node2.Close()
+	}
+}
+
+func TestNodeBan(t *testing.T) {
+	const (
+		banTime = 500 * time.Millisecond
+	)
+
+	node, address := newTestNode(t, NodeConfig{
+		RetryLimit: 3,
+		BanTime:    banTime,
+		MinWork:    32,
+	})
+	peer, peerAddress := newTestNode(t, NodeConfig{})
+
+	if node.Connect(peerAddress) == nil {
+		t.Fatal("node not connected")
+	}
+	waitFor(t, func() bool { return len(peer.Connections()) == 1 })
+
+	// messages without work are failures of connection
+	conn := peer.Connections()[0]
+	for i := 0; i < 3; i++ {
+		if err := peer.Send(conn, NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return node.IsBanned(peerAddress) })
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+	start := time.Now()
+
+	if node.Connect(peerAddress) != nil {
+		t.Fatal("banned address connected")
+	}
+
+	if peer.Connect(address) != nil {
+		t.Fatal("banned address accepted")
+	}
+
+	time.Sleep(banTime - time.Since(start) + 100*time.Millisecond)
+
+	if node.IsBanned(peerAddress) {
+		t.Fatal("ban not expired")
+	}
+
+	if node.Connect(peerAddress) == nil {
+		t.Fatal("address not connected after ban")
+	}
+}
+
+func TestNodeIdleNotBanned(t *testing.T) {
+	node, _ := newTestNode(t, NodeConfig{
+		RetryLimit:  3,
+		ReadTimeout: 20 * time.Millisecond,
+	})
+	_, peerAddress := newTestNode(t, NodeConfig{})
+
+	if node.Connect(peerAddress) == nil {
+		t.Fatal("node not connected")
+	}
+
+	// quiet peer is disconnected after timeouts
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+	time.Sleep(300 * time.Millisecond)
+
+	if node.IsBanned(peerAddress) {
+		t.Fatal("quiet peer is banned")
+	}
+
+	if node.Connect(peerAddress) == nil {
+		t.Fatal("quiet peer not connected again")
+	}
+}
+
+func TestNodeBanInbound(t *testing.T) {
+	node, address := newTestNode(t, NodeConfig{
+		RetryLimit: 3,
+		MinWork:    32,
+	})
+
+	// peer without listener advertises no address
+	peer := NewNode("peer")
+	defer peer.Close()
+
+	conn := peer.Connect(address)
+	if conn == nil {
+		t.Fatal("peer not connected")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := peer.Send(conn, NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return node.IsBanned("127.0.0.1") })
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+
+	other := NewNode("other")
+	defer other.Close()
+
+	if other.Connect(address) != nil {
+		t.Fatal("peer from banned host accepted")
+	}
+
+	node.Unban("127.0.0.1")
+
+	if other.Connect(address) == nil {
+		t.Fatal("peer not accepted after unban")
+	}
+}
+
+// Ban of host keeps outbound connections to it.
+func TestNodeBanHost(t *testing.T) {
+	node, address := newTestNode(t, NodeConfig{})
+	_, peerAddress := newTestNode(t, NodeConfig{})
+
+	if node.Connect(peerAddress) == nil {
+		t.Fatal("node not connected")
+	}
+
+	inbound := NewNode("inbound")
+	defer inbound.Close()
+
+	if inbound.Connect(address) == nil {
+		t.Fatal("peer not connected")
+	}
+	waitFor(t, func() bool { return len(node.Connections()) == 2 })
+
+	// connections are closed by ban itself
+	node.Ban("127.0.0.1", time.Minute)
+	if n := len(node.Connections()); n != 1 {
+		t.Fatalf("got %d connections, expected 1", n)
+	}
+
+	if node.getOutbound(peerAddress) == nil {
+		t.Fatal("outbound connection to banned host is closed")
+	}
+}
+
+// Read from socket until it is closed by node.
+func waitClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(TimeSize * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatal("socket is not closed by node")
+	}
+}
+
+func TestNodeSilentSocket(t *testing.T) {
+	_, address := newTestNode(t, NodeConfig{
+		ReadTimeout: 20 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitClosed(t, conn)
+}
+
+func TestNodeCloseSilentSocket(t *testing.T) {
+	node, address := newTestNode(t, NodeConfig{})
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitFor(t, func() bool {
+		node.mainMtx.Lock()
+		defer node.mainMtx.Unlock()
+		return len(node.accepted) == 1
+	})
+	node.Close()
+
+	waitClosed(t, conn)
+}
+
+// Close can be called twice and stops all goroutines.
+func TestNodeCloseTwice(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	node := NewNode("test")
+	peer := NewNode("peer")
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listen.Addr().String()
+
+	served := make(chan error, 1)
+	go func() { served <- node.Serve(listen) }()
+
+	if peer.Connect(address) == nil {
+		t.Fatal("peer not connected")
+	}
+
+	client, err := NewClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(node.Connections()) == 1 })
+
+	if err := node.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Close(); err != nil {
+		t.Fatalf("second close returned %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(TimeSize * time.Second):
+		t.Fatal("accept loop is not stopped")
+	}
+
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Fatal("closed node accepted connection")
+	}
+
+	waitFor(t, func() bool { return len(peer.Connections()) == 0 })
+
+	client.Close()
+	peer.Close()
+
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// Nodes in line A-B-C, A finds C through B.
+func testDiscoverPeers(t *testing.T, cfg NodeConfig) {
+	nodeA, _ := newTestNode(t, cfg)
+	nodeB, addressB := newTestNode(t, cfg)
+	nodeC, addressC := newTestNode(t, cfg)
+
+	if nodeA.Connect(addressB) == nil || nodeB.Connect(addressC) == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(nodeB.Connections()) == 2 })
+
+	nodeA.DiscoverPeers(ConnSize)
+
+	waitFor(t, func() bool { return nodeA.getOutbound(addressC) != nil })
+	waitFor(t, func() bool { return len(nodeC.Connections()) == 2 })
+}
+
+func TestNodeDiscoverPeers(t *testing.T) {
+	testDiscoverPeers(t, NodeConfig{})
+}
+
+func TestNodeDiscoverPeersWork(t *testing.T) {
+	testDiscoverPeers(t, NodeConfig{MinWork: 8})
+}
+
+// Unmined requests and unsolicited lists are failures.
+func TestNodeDiscoverPeersUnmined(t *testing.T) {
+	var (
+		failures int32
+		served   int32
+	)
+
+	node1, node2, conn := newTestPair(t, NodeConfig{
+		RetryLimit: 8,
+		MinWork:    8,
+	})
+	node2.HandleAnomaly(func(_ Node, _ Conn, anom Anomaly) {
+		if anom == AnomalyWork {
+			atomic.AddInt32(&failures, 1)
+		}
+	})
+	node1.Handle(MsgSetPeers, func(Node, Conn, Message) { atomic.AddInt32(&served, 1) })
+
+	for _, head := range []MsgType{MsgGetPeers, MsgSetPeers} {
+		if err := node1.Send(conn, NewMessageTTL(head, nil, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&failures) == 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Fatalf("got %d lists of peers, expected 0", n)
+	}
+}
+
+// Peer sending twice faster than limit passes
+// half of messages, but connection is dropped.
+func TestNodeRateLimit(t *testing.T) {
+	const (
+		rateLimit = 20
+	)
+
+	var (
+		handled int32
+		dropped int32
+	)
+
+	node, address := newTestNode(t, NodeConfig{
+		RetryLimit: 8,
+		RateLimit:  rateLimit,
+		RateBurst:  2,
+	})
+	node.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&handled, 1) })
+	node.HandleAnomaly(func(_ Node, _ Conn, anom Anomaly) {
+		if anom == AnomalyRate {
+			atomic.AddInt32(&dropped, 1)
+		}
+	})
+
+	peer := NewNode("peer")
+	defer peer.Close()
+
+	conn := peer.Connect(address)
+	if conn == nil {
+		t.Fatal("peer not connected")
+	}
+
+	ticker := time.NewTicker(time.Second / (2 * rateLimit))
+	defer ticker.Stop()
+
+	deadline := time.After(TimeSize * time.Second)
+	for len(node.Connections()) != 0 {
+		select {
+		case <-deadline:
+			t.Fatal("flooding peer is not disconnected")
+		case <-ticker.C:
+			peer.Send(conn, NewMessage(1, nil))
+		}
+	}
+
+	if atomic.LoadInt32(&handled) <= 2 {
+		t.Fatal("messages below limit are not handled")
+	}
+
+	if atomic.LoadInt32(&dropped) < 8 {
+		t.Fatal("messages above limit are not dropped")
+	}
+}
+
+// Config with self-signed certificate of loopback
+// address, trusted by nodes using it.
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		RootCAs:      pool,
+	}
+}
+
+func TestNodeTLS(t *testing.T) {
+	cfg := NodeConfig{TLSConfig: newTestTLSConfig(t)}
+
+	node := NewNodeWithConfig("node", cfg).(*NodeT)
+	defer node.Close()
+
+	listen, err := node.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Serve(listen)
+	address := listen.Addr().String()
+
+	received := make(chan string, 1)
+	node.Handle(1, func(_ Node, _ Conn, msg Message) {
+		received <- string(msg.Body())
+	})
+
+	plain := NewNode("plain")
+	defer plain.Close()
+
+	if plain.Connect(address) != nil {
+		t.Fatal("plaintext peer connected to TLS node")
+	}
+
+	peer := NewNodeWithConfig("peer", cfg)
+	defer peer.Close()
+
+	conn := peer.Connect(address)
+	if conn == nil {
+		t.Fatal("peer not connected over TLS")
+	}
+
+	if _, ok := conn.(*ConnT).ptr.(*countConnT).Conn.(*tls.Conn); !ok {
+		t.Fatal("connection is not encrypted")
+	}
+
+	if conn.Moniker() != "node" {
+		t.Fatal("handshake over TLS is not done")
+	}
+
+	peer.Broadcast(NewMessage(1, []byte("secret")))
+
+	select {
+	case body := <-received:
+		if body != "secret" {
+			t.Fatalf("got %q, expected %q", body, "secret")
+		}
+	case <-time.After(TimeSize * time.Second):
+		t.Fatal("broadcast over TLS not received")
+	}
+}
+
+func TestNodeDrain(t *testing.T) {
+	var received int32
+
+	node, address := newTestNode(t, NodeConfig{})
+	node.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&received, 1) })
+
+	peer := NewNode("peer")
+	defer peer.Close()
+
+	conn := peer.Connect(address)
+	if conn == nil {
+		t.Fatal("peer not connected")
+	}
+
+	for i := 0; i < QueueSize; i++ {
+		if err := peer.Send(conn, NewMessage(1, []byte(fmt.Sprintf("msg-%d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !peer.Drain(conn, TimeSize*time.Second) {
+		t.Fatal("connection not drained")
+	}
+
+	if len(peer.Connections()) != 0 {
+		t.Fatal("drained connection is not closed")
+	}
+
+	// messages read before close are handled
+	// before connection is removed
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+
+	if n := atomic.LoadInt32(&received); n != QueueSize {
+		t.Fatalf("received %d messages, expected %d", n, QueueSize)
+	}
+}
+
+// List of peers is limited by request,
+// own address and unsolicited lists are not dialed.
+func TestNodeDiscoverPeersGuards(t *testing.T) {
+	nodeA, addressA := newTestNode(t, NodeConfig{})
+	nodeB, addressB := newTestNode(t, NodeConfig{})
+	nodeC, addressC := newTestNode(t, NodeConfig{})
+	nodeD, addressD := newTestNode(t, NodeConfig{})
+
+	if nodeA.Connect(addressB) == nil || nodeB.Connect(addressC) == nil || nodeB.Connect(addressD) == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(nodeB.Connections()) == 3 })
+
+	nodeA.DiscoverPeers(1)
+	waitFor(t, func() bool { return len(nodeA.Connections()) == 2 })
+
+	// list of B includes address of A
+	time.Sleep(200 * time.Millisecond)
+	if n := len(nodeA.Connections()); n != 2 {
+		t.Fatalf("node has %d connections, expected 2", n)
+	}
+
+	if nodeA.getID(nodeA.id) != nil || nodeA.getOutbound(addressA) != nil {
+		t.Fatal("node connected to itself")
+	}
+
+	missed := addressC
+	if nodeA.getOutbound(addressC) != nil {
+		missed = addressD
+	}
+
+	peers, err := json.Marshal([]string{missed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conn Conn
+	for _, c := range nodeB.Connections() {
+		if c.(*ConnT).id == nodeA.id {
+			conn = c
+		}
+	}
+
+	if err := nodeB.Send(conn, NewMessageTTL(MsgSetPeers, peers, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if nodeA.getOutbound(missed) != nil {
+		t.Fatal("unsolicited list of peers is dialed")
+	}
+
+	if len(nodeC.Connections())+len(nodeD.Connections()) != 3 {
+		t.Fatal("node dialed more peers than requested")
+	}
+}
+
+// Peer not reading from connection does not
+// delay broadcast to other peers.
+func TestNodeSlowPeer(t *testing.T) {
+	const (
+		numFast = 3
+		numMsgs = QueueSize + 8
+	)
+
+	node := NewNode("node").(*NodeT)
+	defer node.Close()
+
+	// writes to pipe are blocked until read
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	slow := newConn(local, "slow", false)
+	node.mainMtx.Lock()
+	node.connections[slow.nonce] = slow
+	node.mainMtx.Unlock()
+
+	var received int32
+	for i := 0; i < numFast; i++ {
+		peer, address := newTestNode(t, NodeConfig{})
+		peer.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&received, 1) })
+
+		if node.Connect(address) == nil {
+			t.Fatal("node not connected")
+		}
+	}
+
+	// fast peers write messages before next one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < numMsgs; i++ {
+			node.Broadcast(NewMessage(1, nil))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(TimeSize * time.Second):
+		t.Fatal("broadcast is stalled by slow peer")
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == numFast*numMsgs })
+
+	// one message is being written, queue is full
+	if n := slow.Dropped(); n != numMsgs-QueueSize-1 {
+		t.Fatalf("slow peer dropped %d messages, expected %d", n, numMsgs-QueueSize-1)
+	}
+}
+
+func TestNodeMoniker(t *testing.T) {
+	node1, _ := newTestNode(t, NodeConfig{})
+	node2, address := newTestNode(t, NodeConfig{})
+
+	node1.SetMoniker("alice")
+	node2.SetMoniker("bob")
+
+	conn1 := node1.Connect(address)
+	if conn1 == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(node2.Connections()) == 1 })
+	conn2 := node2.Connections()[0]
+
+	if conn1.Moniker() != "bob" || conn2.Moniker() != "alice" {
+		t.Fatalf("got monikers %q and %q", conn1.Moniker(), conn2.Moniker())
+	}
+}
+
+func TestNodeMaxMsgSize(t *testing.T) {
+	node, address := newTestNode(t, NodeConfig{MaxMsgSize: 1024})
+
+	conn := dialTestConn(t, address)
+	waitFor(t, func() bool { return len(node.Connections()) == 1 })
+
+	// body of such size is never allocated
+	conn.ptr.Write(encoding.Uint64ToBytes(1 << 40))
+
+	waitClosed(t, conn.ptr)
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+}
+
+func TestNodeSendReply(t *testing.T) {
+	var replies int32
+
+	node1, node2, conn := newTestPair(t, NodeConfig{})
+	node1.Handle(2, func(Node, Conn, Message) { atomic.AddInt32(&replies, 1) })
+	node2.Handle(1, func(node Node, conn Conn, msg Message) {
+		if err := node.Send(conn, NewMessage(2, msg.Body())); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&replies) == 1 })
+	time.Sleep(100 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&replies); n != 1 {
+		t.Fatalf("received %d replies, expected 1", n)
+	}
+
+	node1.Disconnect(conn)
+	if err := node1.Send(conn, NewMessage(1, nil)); err != ErrNotConnected {
+		t.Fatalf("got error %v, expected %v", err, ErrNotConnected)
+	}
+}
+
+func TestNodeHandlerPanic(t *testing.T) {
+	node1, node2, conn := newTestPair(t, NodeConfig{RetryLimit: 3})
+	node2.Handle(1, func(Node, Conn, Message) { panic("handler failed") })
+
+	for i := 0; i < 3; i++ {
+		if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// panics are recovered and break connection
+	waitFor(t, func() bool { return len(node2.Connections()) == 0 })
+
+	if n := node2.Stats().HandlerErrors; n != 3 {
+		t.Fatalf("got %d handler errors, expected 3", n)
+	}
+
+	if node2.isClosed() {
+		t.Fatal("node is closed by panic")
+	}
+}
+
+// Nodes in line A-B-C, B relays to C only.
+func TestNodeBroadcastExcept(t *testing.T) {
+	var received int32
+
+	nodeA, _ := newTestNode(t, NodeConfig{})
+	nodeB, addressB := newTestNode(t, NodeConfig{})
+	nodeC, addressC := newTestNode(t, NodeConfig{})
+
+	nodeB.Handle(1, func(node Node, conn Conn, msg Message) {
+		node.BroadcastExcept(conn, msg)
+	})
+	nodeC.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&received, 1) })
+
+	if nodeA.Connect(addressB) == nil || nodeB.Connect(addressC) == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(nodeB.Connections()) == 2 })
+
+	nodeA.Broadcast(NewMessage(1, nil))
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 1 })
+	time.Sleep(100 * time.Millisecond)
+
+	// echo would be dropped as duplicate
+	if n := nodeA.Stats().MessagesDeduped; n != 0 {
+		t.Fatalf("message sent back to origin %d times", n)
+	}
+}
+
+func TestNodeConnectTwice(t *testing.T) {
+	node1, node2, conn := newTestPair(t, NodeConfig{})
+
+	_, port, err := net.SplitHostPort(node2.listenAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{node2.listenAddress(), "localhost:" + port} {
+		if node1.Connect(address) != conn {
+			t.Fatalf("address %s is dialed again", address)
+		}
+	}
+
+	if n := len(node1.Connections()); n != 1 {
+		t.Fatalf("node has %d connections, expected 1", n)
+	}
+}
+
+func TestNodeReconnect(t *testing.T) {
+	node, _ := newTestNode(t, NodeConfig{
+		RedialBase: 20 * time.Millisecond,
+		RedialMax:  100 * time.Millisecond,
+	})
+	peer, address := newTestNode(t, NodeConfig{})
+
+	node.ConnectPersistent(address)
+	waitFor(t, func() bool { return node.getOutbound(address) != nil })
+
+	peer.Close()
+	waitFor(t, func() bool { return len(node.Connections()) == 0 })
+
+	// peer is restarted on the same address
+	restarted := NewNode("restarted").(*NodeT)
+	defer restarted.Close()
+
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go restarted.Serve(listen)
+
+	waitFor(t, func() bool { return node.getOutbound(address) != nil })
+
+	if conn := node.getOutbound(address); conn.Moniker() != "restarted" {
+		t.Fatal("node is not connected to restarted peer")
+	}
+}
+
+// Nodes in line A-B-C-D relay message of A with TTL 2.
+func TestNodeTTL(t *testing.T) {
+	var (
+		nodes     [4]*NodeT
+		addresses [4]string
+		received  [4]int32
+	)
+
+	for i := range nodes {
+		i := i
+		nodes[i], addresses[i] = newTestNode(t, NodeConfig{})
+		nodes[i].Handle(1, func(node Node, conn Conn, msg Message) {
+			atomic.AddInt32(&received[i], 1)
+			node.BroadcastExcept(conn, msg)
+		})
+	}
+
+	for i := 0; i < len(nodes)-1; i++ {
+		if nodes[i].Connect(addresses[i+1]) == nil {
+			t.Fatal("nodes not connected")
+		}
+	}
+	waitFor(t, func() bool { return len(nodes[len(nodes)-1].Connections()) == 1 })
+
+	nodes[0].Broadcast(NewMessageTTL(1, nil, 2))
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received[2]) == 1 })
+	time.Sleep(100 * time.Millisecond)
+
+	for i, expected := range []int32{0, 1, 1, 0} {
+		if n := atomic.LoadInt32(&received[i]); n != expected {
+			t.Fatalf("node %d received %d messages, expected %d", i, n, expected)
+		}
+	}
+}
+
+// Messages of formats without ttl are relayed.
+func TestNodeTTLLegacy(t *testing.T) {
+	var received int32
+
+	nodeB, addressB := newTestNode(t, NodeConfig{})
+	nodeC, addressC := newTestNode(t, NodeConfig{})
+
+	nodeB.Handle(1, func(node Node, conn Conn, msg Message) {
+		node.BroadcastExcept(conn, msg)
+	})
+	nodeC.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&received, 1) })
+
+	if nodeB.Connect(addressC) == nil {
+		t.Fatal("nodes not connected")
+	}
+
+	conn := dialTestConn(t, addressB)
+	waitFor(t, func() bool { return len(nodeB.Connections()) == 2 })
+
+	for _, version := range []uint8{0, 1} {
+		msg := NewMessage(1, nil).(*MessageT)
+		msg.VersionT = version
+		msg.TTLT = 0
+		conn.Write(msg)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 2 })
+}
+
+// Inbound peer is listed by its listen address.
+func TestNodePeers(t *testing.T) {
+	node1, node2, _ := newTestPair(t, NodeConfig{})
+
+	peers1, peers2 := node1.Peers(), node2.Peers()
+	if len(peers1) != 1 || len(peers2) != 1 {
+		t.Fatalf("nodes have %d and %d peers, expected 1", len(peers1), len(peers2))
+	}
+
+	if peers1[0] != node2.listenAddress() {
+		t.Fatalf("got peer %s, expected %s", peers1[0], node2.listenAddress())
+	}
+
+	if peers2[0] != node1.listenAddress() {
+		t.Fatalf("got peer %s, expected %s", peers2[0], node1.listenAddress())
+	}
+}
+
+func TestNodeHandleDefault(t *testing.T) {
+	var (
+		handled   int32
+		defaulted int32
+	)
+
+	node1, node2, conn := newTestPair(t, NodeConfig{RetryLimit: 2})
+	node2.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&handled, 1) })
+
+	// unknown types are ignored without counting
+	for i := 0; i < 4; i++ {
+		if err := node1.Send(conn, NewMessage(2, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&handled) == 1 })
+
+	if len(node2.Connections()) != 1 {
+		t.Fatal("connection dropped for unknown types")
+	}
+
+	node2.HandleDefault(func(_ Node, _ Conn, msg Message) {
+		if msg.Head() == 2 {
+			atomic.AddInt32(&defaulted, 1)
+		}
+	})
+
+	if err := node1.Send(conn, NewMessage(2, nil)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&defaulted) == 1 })
+}
+
+func TestNodeRemoveHandle(t *testing.T) {
+	heads := make(chan MsgType, 1)
+
+	node1, node2, conn := newTestPair(t, NodeConfig{})
+	node2.Handle(1, func(Node, Conn, Message) { t.Error("removed route is called") })
+	node2.Handle(2, func(Node, Conn, Message) {})
+	node2.HandleDefault(func(_ Node, _ Conn, msg Message) { heads <- msg.Head() })
+
+	node2.RemoveHandle(1)
+	node2.RemoveHandle(3)
+
+	routes := make(map[MsgType]bool)
+	for _, tmsg := range node2.Handlers() {
+		routes[tmsg] = true
+	}
+
+	if routes[1] || !routes[2] {
+		t.Fatal("handlers do not reflect removed route")
+	}
+
+	if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case head := <-heads:
+		if head != 1 {
+			t.Fatalf("got type %d, expected 1", head)
+		}
+	case <-time.After(TimeSize * time.Second):
+		t.Fatal("message of removed type not passed to default")
+	}
+}
+
+func TestNodeConnectTimeout(t *testing.T) {
+	const (
+		timeout = 200 * time.Millisecond
+	)
+
+	node := NewNodeWithConfig("test", NodeConfig{ConnectTimeout: timeout})
+	defer node.Close()
+
+	// address is not routable, so dial is not answered
+	start := time.Now()
+	if node.Connect("10.255.255.1:1") != nil {
+		t.Fatal("non-routable address connected")
+	}
+
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Fatalf("connect returned after %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start = time.Now()
+	if node.ConnectContext(ctx, "10.255.255.1:1") != nil {
+		t.Fatal("address connected with canceled context")
+	}
+
+	if elapsed := time.Since(start); elapsed > timeout {
+		t.Fatalf("connect with canceled context returned after %s", elapsed)
+	}
+}
+
+type testLoggerT struct {
+	mtx  sync.Mutex
+	msgs []string
+}
+
+func (lg *testLoggerT) Debug(msg string, kv ...interface{}) { lg.add(msg) }
+func (lg *testLoggerT) Info(msg string, kv ...interface{})  { lg.add(msg) }
+func (lg *testLoggerT) Warn(msg string, kv ...interface{})  { lg.add(msg) }
+func (lg *testLoggerT) Error(msg string, kv ...interface{}) { lg.add(msg) }
+
+func (lg *testLoggerT) add(msg string) {
+	lg.mtx.Lock()
+	defer lg.mtx.Unlock()
+
+	lg.msgs = append(lg.msgs, msg)
+}
+
+func (lg *testLoggerT) has(msg string) bool {
+	lg.mtx.Lock()
+	defer lg.mtx.Unlock()
+
+	for _, m := range lg.msgs {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNodeLogger(t *testing.T) {
+	logger := &testLoggerT{}
+	node, address := newTestNode(t, NodeConfig{Logger: logger})
+
+	// unknown role fails handshake
+	ptr, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptr.Close()
+
+	ptr.Write([]byte{0xFF})
+	waitFor(t, func() bool { return logger.has("handshake failed") })
+
+	conn := dialTestConn(t, address)
+	waitFor(t, func() bool { return len(node.Connections()) == 1 })
+	if !logger.has("connection added") {
+		t.Fatal("added connection is not logged")
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return logger.has("connection dropped") })
+}
+
+// Logger reading state of node.
+type stateLoggerT struct {
+	node atomic.Value
+	logs int32
+}
+
+func (lg *stateLoggerT) Debug(string, ...interface{}) { lg.read() }
+func (lg *stateLoggerT) Info(string, ...interface{})  { lg.read() }
+func (lg *stateLoggerT) Warn(string, ...interface{})  { lg.read() }
+func (lg *stateLoggerT) Error(string, ...interface{}) { lg.read() }
+
+func (lg *stateLoggerT) read() {
+	if node, ok := lg.node.Load().(Node); ok {
+		node.Stats()
+		node.Capacity()
+		node.Connections()
+	}
+	atomic.AddInt32(&lg.logs, 1)
+}
+
+func TestNodeLoggerState(t *testing.T) {
+	logger := &stateLoggerT{}
+
+	node1, node2, conn := newTestPair(t, NodeConfig{
+		Logger:      logger,
+		MappingSize: 1,
+	})
+	logger.node.Store(Node(node2))
+
+	// hashes are evicted from mapping of size one
+	for i := 0; i < 3; i++ {
+		if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node3, _ := newTestNode(t, NodeConfig{})
+	if node3.Connect(node2.listenAddress()) == nil {
+		t.Fatal("node not connected")
+	}
+	waitFor(t, func() bool { return len(node2.Connections()) == 2 })
+
+	if atomic.LoadInt32(&logger.logs) == 0 {
+		t.Fatal("nothing is logged")
+	}
+}
+
+func TestNodeStats(t *testing.T) {
+	var received int32
+
+	node1, node2, conn := newTestPair(t, NodeConfig{})
+	node2.Handle(1, func(Node, Conn, Message) { atomic.AddInt32(&received, 1) })
+
+	stats := node2.Stats()
+	if stats.ActiveConnections != 1 || stats.TotalConnections != 1 {
+		t.Fatalf("got connections %d/%d, expected 1/1",
+			stats.ActiveConnections, stats.TotalConnections)
+	}
+
+	msg := NewMessage(1, []byte("hello"))
+	node1.Broadcast(msg)
+	waitFor(t, func() bool { return atomic.LoadInt32(&received) == 1 })
+
+	// same nonce is deduplicated
+	if err := node1.Send(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return node2.Stats().MessagesDeduped == 1 })
+
+	if n := node1.Stats().MessagesBroadcast; n != 1 {
+		t.Fatalf("got %d broadcasts, expected 1", n)
+	}
+	if node1.Stats().BytesSent == 0 || node2.Stats().BytesReceived == 0 {
+		t.Fatal("bytes are not counted")
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return node2.Stats().ActiveConnections == 0 })
+
+	if n := node2.Stats().TotalConnections; n != 1 {
+		t.Fatalf("got %d total connections, expected 1", n)
+	}
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Fatalf("got %d messages, expected 1", n)
+	}
+}
+
+func TestNodeKnownPeers(t *testing.T) {
+	nodeA, _ := newTestNode(t, NodeConfig{})
+	_, addressB := newTestNode(t, NodeConfig{})
+	nodeC, addressC := newTestNode(t, NodeConfig{})
+	nodeD, _ := newTestNode(t, NodeConfig{})
+
+	if nodeA.Connect(addressB) == nil || nodeA.Connect(addressC) == nil {
+		t.Fatal("nodes not connected")
+	}
+	if nodeD.Connect(nodeA.listenAddress()) == nil {
+		t.Fatal("nodes not connected")
+	}
+	waitFor(t, func() bool { return len(nodeA.Connections()) == 3 })
+
+	nodeC.Close()
+	waitFor(t, func() bool { return len(nodeA.Connections()) == 2 })
+
+	peers := make(map[string]PeerInfo)
+	for _, peer := range nodeA.KnownPeers() {
+		if peer.LastSeen.IsZero() {
+			t.Fatalf("peer %s is never seen", peer.Address)
+		}
+		peers[peer.Address] = peer
+	}
+
+	if len(peers) != 3 {
+		t.Fatalf("got %d known peers, expected 3", len(peers))
+	}
+
+	if peer := peers[addressB]; !peer.Connected || peer.Inbound {
+		t.Fatalf("dialed peer is %+v", peer)
+	}
+	if peer := peers[addressC]; peer.Connected || peer.Inbound {
+		t.Fatalf("dialed down peer is %+v", peer)
+	}
+
+	inbound := 0
+	for address, peer := range peers {
+		if address == addressB || address == addressC {
+			continue
+		}
+		if !peer.Connected || !peer.Inbound {
+			t.Fatalf("inbound peer is %+v", peer)
+		}
+		inbound++
+	}
+	if inbound != 1 {
+		t.Fatalf("got %d inbound peers, expected 1", inbound)
+	}
+}
+
+func TestNodeAnomaly(t *testing.T) {
+	type anomalyT struct {
+		conn Conn
+		anom Anomaly
+	}
+
+	anomalies := make(chan anomalyT, 8)
+
+	node1, node2, conn := newTestPair(t, NodeConfig{
+		RetryLimit: 8,
+		MinWork:    8,
+	})
+	node2.HandleAnomaly(func(_ Node, conn Conn, anom Anomaly) {
+		anomalies <- anomalyT{conn, anom}
+	})
+
+	expect := func(anom Anomaly) {
+		select {
+		case got := <-anomalies:
+			if got.anom != anom {
+				t.Fatalf("got anomaly %d, expected %d", got.anom, anom)
+			}
+			if got.conn != node2.Connections()[0] {
+				t.Fatal("anomaly reported for another connection")
+			}
+		case <-time.After(TimeSize * time.Second):
+			t.Fatalf("anomaly %d is not reported", anom)
+		}
+	}
+
+	if err := node1.Send(conn, NewMessage(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+	expect(AnomalyWork)
+
+	// no handler for type of mined message
+	if err := node1.Send(conn, NewMessagePoW(1, nil, 8)); err != nil {
+		t.Fatal(err)
+	}
+	expect(AnomalyRoute)
+}
+
+func TestNodeHandleRole(t *testing.T) {
+	const (
+		role = 3
+	)
+
+	var accepted int32
+
+	node, address := newTestNode(t, NodeConfig{})
+	node.HandleRole(role, func(Node, Conn) bool {
+		atomic.AddInt32(&accepted, 1)
+		return true
+	})
+	node.Handle(1, func(_ Node, conn Conn, msg Message) {
+		conn.Write(NewResponse(msg, 2, msg.Body()))
+	})
+
+	ptr, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr.Write([]byte{role})
+
+	conn := newConn(ptr, address, false)
+	defer conn.Close()
+
+	conn.Write(NewMessage(1, []byte("hello")))
+	resp := conn.Read()
+	if resp == nil || string(resp.Body()) != "hello" {
+		t.Fatal("message of custom role is not routed")
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("role accepted %d times, expected 1", n)
+	}
+
+	// unknown role is closed
+	unknown, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknown.Close()
+
+	unknown.Write([]byte{role + 1})
+	waitClosed(t, unknown)
+
+	// connection of role is not added as node or client
+	node.Close()
+	waitClosed(t, ptr)
+}
+
+// Connection of other implementation.
+type testConnT struct{}
+
+func (conn *testConnT) Request(Message) Message { return nil }
+func (conn *testConnT) Close() error            { return nil }
+func (conn *testConnT) Write(Message)           {}
+func (conn *testConnT) Read() Message           { return nil }
+func (conn *testConnT) Moniker() string         { return "" }
+func (conn *testConnT) Address() string         { return "" }
+func (conn *testConnT) Dropped() uint64         { return 0 }
+
+// Connections not created by node are rejected without panic.
+func TestNodeForeignConn(t *testing.T) {
+	node, _, _ := newTestPair(t, NodeConfig{})
+	foreign := &testConnT{}
+
+	if err := node.Send(foreign, NewMessage(1, nil)); err != ErrNotConnected {
+		t.Fatalf("got error %v, expected %v", err, ErrNotConnected)
+	}
+
+	if node.Drain(foreign, time.Second) {
+		t.Fatal("foreign connection is drained")
+	}
+
+	node.Disconnect(foreign)
+	node.BroadcastExcept(foreign, NewMessage(1, nil))
+
+	if n := len(node.Connections()); n != 1 {
+		t.Fatalf("got %d connections, expected 1", n)
+	}
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Ask connected peers for their peers and dial
+// at most max addresses not connected yet.
+// Lists are accepted only as responses to own request,
+// and are never relayed, so exchange can not amplify.
+// Request is mined as other messages, since every
+// request makes peer build and send list of peers.
+func (node *NodeT) DiscoverPeers(max int) {
+	if max <= 0 || node.isClosed() {
+		return
+	}
+
+	msg := NewMessagePoW(MsgGetPeers, nil, node.config.MinWork).(*MessageT)
+	msg.TTLT = 1
+	nonce := string(msg.Nonce())
+
+	node.mainMtx.Lock()
+	node.discovery[nonce] = max
+	node.mainMtx.Unlock()
+
+	time.AfterFunc(TimeSize*time.Second, func() {
+		node.mainMtx.Lock()
+		defer node.mainMtx.Unlock()
+
+		delete(node.discovery, nonce)
+	})
+
+	node.broadcast(nil, msg, PriorityLow)
+}
+
+// Response with list of connected peers.
+func handleGetPeers(node Node, conn Conn, msg Message) {
+	peers, err := json.Marshal(node.Peers())
+	if err != nil {
+		return
+	}
+
+	resp := NewResponse(msg, MsgSetPeers, peers)
+	resp.(*MessageT).TTLT = 1
+
+	node.Send(conn, resp)
+}
+
+// Dial unknown addresses from response to discovery request.
+func handleSetPeers(node Node, conn Conn, msg Message) {
+	inode := node.(*NodeT)
+
+	var peers []string
+	if err := json.Unmarshal(msg.Body(), &peers); err != nil {
+		return
+	}
+
+	known := make(map[string]bool)
+	for _, address := range inode.Peers() {
+		known[address] = true
+	}
+
+	for _, address := range peers {
+		if known[address] || inode.isSelf(address) {
+			continue
+		}
+		known[address] = true
+
+		if !inode.takeDiscovery(string(msg.Nonce())) {
+			return
+		}
+
+		go inode.Connect(address)
+	}
+}
+
+// Response to pending discovery of node. Responses keep
+// nonce of request, so they are not mined.
+func (node *NodeT) isDiscovery(msg Message) bool {
+	if msg.Head() != MsgSetPeers {
+		return false
+	}
+
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	_, ok := node.discovery[string(msg.Nonce())]
+	return ok
+}
+
+// Decrease number of addresses left to dial for request.
+func (node *NodeT) takeDiscovery(nonce string) bool {
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	left, ok := node.discovery[nonce]
+	if !ok {
+		return false
+	}
+
+	if left <= 1 {
+		delete(node.discovery, nonce)
+	} else {
+		node.discovery[nonce] = left - 1
+	}
+
+	return true
+}
+
+// Address is one of own listeners.
+// Listener on unspecified host accepts any local address.
+func (node *NodeT) isSelf(address string) bool {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return false
+	}
+
+	node.mainMtx.Lock()
+	defer node.mainMtx.Unlock()
+
+	for listen := range node.listeners {
+		laddr, ok := listen.Addr().(*net.TCPAddr)
+		if !ok || laddr.Port != addr.Port {
+			continue
+		}
+
+		if laddr.IP.Equal(addr.IP) {
+			return true
+		}
+
+		if laddr.IP.IsUnspecified() && isLocalIP(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
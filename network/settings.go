@@ -1,18 +1,61 @@
 package network
 
+import "time"
+
+const (
+	MappSize    = 2048      // hashes
+	ConnSize    = 512       // max num connections
+	RetrySize   = 32        // num retry send
+	TimeSize    = 5         // seconds
+	PackSize    = (2 << 20) // 2MiB
+	QueueSize   = 64        // messages in send queue
+	StarveSize  = 8         // messages before low priority is taken
+	NonceSize   = 16        // bytes
+	MonikerSize = 256       // bytes
+	TTLSize     = 255       // max hops of message
+)
+
 const (
-	MappSize  = 2048      // hashes
-	ConnSize  = 512       // max num connections
-	RetrySize = 32        // num retry send
-	TimeSize  = 5         // seconds
-	PackSize  = (2 << 20) // 2MiB
+	DrainTime  = 10 * time.Millisecond
+	DialTime   = 5 * time.Second
+	RedialBase = 1 * time.Second
+	RedialMax  = 1 * time.Minute
+	StableTime = 30 * time.Second // uptime resetting redial backoff
+	BanTime    = 10 * time.Minute
+	RateWindow = 10 * time.Second // window of messages dropped by rate limit
 )
 
 const (
 	NetworkName = "union-network"
+	MsgVersion  = 2 // format of serialized message
+	TTLVersion  = 2 // first format with ttl of message
+)
+
+// Reserved message types of peer exchange.
+const (
+	MsgGetPeers MsgType = 0x7FFFFF01
+	MsgSetPeers MsgType = 0x7FFFFF02
 )
 
 const (
 	IsNode   byte = 1
 	IsClient byte = 2
 )
+
+const (
+	AnomalyRead    Anomaly = 1 // malformed or failed read
+	AnomalyReplay  Anomaly = 2 // message already seen
+	AnomalyRoute   Anomaly = 3 // no handler for message type, not counted
+	AnomalyPanic   Anomaly = 4 // handler panicked
+	AnomalyWork    Anomaly = 5 // not enough proof of work
+	AnomalyRate    Anomaly = 6 // rate limit of connection exceeded
+	AnomalyIdle    Anomaly = 7 // read deadline expired, not banned
+	AnomalyVersion Anomaly = 8 // message of newer format, not counted
+)
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	PrioritySize
+)
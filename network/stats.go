@@ -0,0 +1,55 @@
+package network
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Counters of node updated atomically.
+type statsT struct {
+	bytesSent         uint64
+	bytesReceived     uint64
+	messagesBroadcast uint64
+	messagesDeduped   uint64
+	handlerErrors     uint64
+	totalConnections  uint64
+}
+
+// Connection counting bytes of node.
+type countConnT struct {
+	net.Conn
+	stats *statsT
+}
+
+func (conn *countConnT) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddUint64(&conn.stats.bytesReceived, uint64(n))
+	return n, err
+}
+
+func (conn *countConnT) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddUint64(&conn.stats.bytesSent, uint64(n))
+	return n, err
+}
+
+// Snapshot of node counters.
+func (node *NodeT) Stats() NodeStats {
+	active, _ := node.Capacity()
+	return NodeStats{
+		BytesSent:         atomic.LoadUint64(&node.stats.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&node.stats.bytesReceived),
+		MessagesBroadcast: atomic.LoadUint64(&node.stats.messagesBroadcast),
+		MessagesDeduped:   atomic.LoadUint64(&node.stats.messagesDeduped),
+		HandlerErrors:     atomic.LoadUint64(&node.stats.handlerErrors),
+		ActiveConnections: uint64(active),
+		TotalConnections:  atomic.LoadUint64(&node.stats.totalConnections),
+	}
+}
+
+func (node *NodeT) counted(conn net.Conn) net.Conn {
+	return &countConnT{
+		Conn:  conn,
+		stats: &node.stats,
+	}
+}
@@ -1,18 +1,87 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"sync"
+	"time"
 )
 
 type MsgType uint32
 type HandleFunc func(Node, Conn, Message)
+type RoleFunc func(Node, Conn) bool
+type ConnFunc func(Node, Conn)
+
+type Priority uint8
+type Anomaly uint8
+type AnomalyFunc func(Node, Conn, Anomaly)
+
+type NodeConfig struct {
+	MaxConns    uint
+	MappingSize uint
+	RetryLimit  uint
+	MaxMsgSize  uint64
+
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	ConnectTimeout time.Duration
+
+	RedialBase time.Duration
+	RedialMax  time.Duration
+	BanTime    time.Duration
+
+	// Plaintext connections are used if nil.
+	TLSConfig *tls.Config
+
+	// Nothing is logged if nil.
+	Logger Logger
+
+	// Messages with hash of less leading zero bits
+	// are dropped, work is not required if zero.
+	// Only responses to own discovery of peers do not need work.
+	MinWork uint8
+
+	// Messages per second and burst of one connection,
+	// rate is not limited if zero.
+	RateLimit float64
+	RateBurst uint
+}
+
+type PeerInfo struct {
+	Address   string
+	Inbound   bool
+	Connected bool
+	LastSeen  time.Time
+}
+
+// Messages are logged with key-value pairs.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+type NodeStats struct {
+	BytesSent         uint64
+	BytesReceived     uint64
+	MessagesBroadcast uint64
+	MessagesDeduped   uint64
+	HandlerErrors     uint64
+	ActiveConnections uint64
+	TotalConnections  uint64
+}
 
 type Message interface {
+	Version() uint8
 	Head() MsgType
 	Body() []byte
 
 	Nonce() []byte
 	Network() string
+	TTL() uint8
+	Work() uint8
 
 	Hash() string
 	Bytes() []byte
@@ -32,16 +101,52 @@ type Conn interface {
 
 	Write(Message)
 	Read() Message
+	Moniker() string
+	Address() string
+	Dropped() uint64
+}
+
+type Client interface {
+	Request(Message) Message
+	Close() error
 }
 
 type Node interface {
+	Moniker() string
+	SetMoniker(string)
 	Mutex() *sync.Mutex
 
 	Broadcast(Message)
+	BroadcastPriority(Message, Priority)
+	BroadcastExcept(Conn, Message)
+	Send(Conn, Message) error
 	Listen(string) error
+	ListenContext(context.Context, string) error
+	Serve(net.Listener) error
+	Close() error
 	Handle(MsgType, HandleFunc) Node
+	HandleDefault(HandleFunc) Node
+	RemoveHandle(MsgType) Node
+	Handlers() []MsgType
+	HandleRole(byte, RoleFunc) Node
+	HandleAnomaly(AnomalyFunc) Node
+	OnConnect(ConnFunc) Node
+	OnDisconnect(ConnFunc) Node
 
 	Connect(string) Conn
+	ConnectContext(context.Context, string) Conn
+	ConnectPersistent(string)
 	Disconnect(Conn)
+	Drain(Conn, time.Duration) bool
+	DrainAll(time.Duration)
 	Connections() []Conn
+	Peers() []string
+	DiscoverPeers(int)
+	KnownPeers() []PeerInfo
+	Capacity() (int, int)
+	Stats() NodeStats
+
+	Ban(string, time.Duration)
+	Unban(string)
+	IsBanned(string) bool
 }
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/number571/go-peer/encoding"
+	"github.com/number571/union-bc/kernel"
+	"github.com/number571/union-bc/network"
+)
+
+var (
+	ErrNoResponse    = errors.New("protocol: peer did not respond")
+	ErrBlockInvalid  = errors.New("protocol: block of peer is invalid")
+	ErrBlockRejected = errors.New("protocol: block of peer is rejected")
+	ErrOtherChain    = errors.New("protocol: peer has no common block")
+)
+
+// Reply with height of chain.
+func HandleGetHeight(chain kernel.Chain) network.HandleFunc {
+	return func(node network.Node, conn network.Conn, msg network.Message) {
+		conn.Write(network.NewResponse(
+			msg,
+			MsgGetHeight|MaskBit,
+			encoding.Uint64ToBytes(uint64(chain.Height())),
+		))
+	}
+}
+
+// Reply with block at requested height.
+// Body is empty if block is not found.
+func HandleGetBlock(chain kernel.Chain) network.HandleFunc {
+	return func(node network.Node, conn network.Conn, msg network.Message) {
+		var (
+			height     = kernel.Height(encoding.BytesToUint64(msg.Body()))
+			block      = chain.Block(height)
+			blockBytes = []byte{}
+		)
+
+		if block != nil {
+			blockBytes = block.Bytes()
+		}
+
+		conn.Write(network.NewResponse(
+			msg,
+			MsgGetBlock|MaskBit,
+			blockBytes,
+		))
+	}
+}
+
+func GetHeight(client network.Client) (kernel.Height, error) {
+	msg := client.Request(network.NewMessage(MsgGetHeight, nil))
+	if msg == nil {
+		return 0, ErrNoResponse
+	}
+
+	return kernel.Height(encoding.BytesToUint64(msg.Body())), nil
+}
+
+func GetBlock(client network.Client, height kernel.Height) (kernel.Block, error) {
+	msg := client.Request(network.NewMessage(
+		MsgGetBlock,
+		encoding.Uint64ToBytes(uint64(height)),
+	))
+	if msg == nil {
+		return nil, ErrNoResponse
+	}
+
+	block := kernel.LoadBlock(msg.Body())
+	if block == nil {
+		return nil, ErrBlockInvalid
+	}
+
+	return block, nil
+}
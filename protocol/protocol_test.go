@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/number571/go-peer/encoding"
+	"github.com/number571/union-bc/kernel"
+	"github.com/number571/union-bc/network"
+)
+
+// Client answering requests of height and block
+// with bodies, request fails if body is nil.
+type testClientT struct {
+	height []byte
+	block  []byte
+}
+
+func (client *testClientT) Request(msg network.Message) network.Message {
+	body := client.height
+	if msg.Head() == MsgGetBlock {
+		body = client.block
+	}
+
+	if body == nil {
+		return nil
+	}
+	return network.NewResponse(msg, msg.Head()|MaskBit, body)
+}
+
+func (client *testClientT) Close() error {
+	return nil
+}
+
+// Failed reads are returned as errors without panic.
+func TestRequestFailed(t *testing.T) {
+	var (
+		chain  = newTestChain(t, newTestBlock([]byte(kernel.ChainID)), 0)
+		height = encoding.Uint64ToBytes(1)
+	)
+
+	tests := []struct {
+		name   string
+		client *testClientT
+		err    error
+	}{
+		{"no height", &testClientT{nil, nil}, ErrNoResponse},
+		{"no block", &testClientT{height, nil}, ErrNoResponse},
+		{"empty block", &testClientT{height, []byte{}}, ErrBlockInvalid},
+		{"garbage block", &testClientT{height, []byte("garbage")}, ErrBlockInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := SyncFrom(chain, test.client); err != test.err {
+				t.Fatalf("got sync error %v, expected %v", err, test.err)
+			}
+
+			if test.client.height == nil {
+				if _, err := GetHeight(test.client); err != test.err {
+					t.Fatalf("got height error %v, expected %v", err, test.err)
+				}
+				return
+			}
+
+			if block, err := GetBlock(test.client, 0); block != nil || err != test.err {
+				t.Fatalf("got block error %v, expected %v", err, test.err)
+			}
+		})
+	}
+
+	if chain.Height() != 0 {
+		t.Fatalf("height is %d, expected 0", chain.Height())
+	}
+}
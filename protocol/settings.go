@@ -0,0 +1,12 @@
+package protocol
+
+import "github.com/number571/union-bc/network"
+
+const (
+	MsgGetHeight network.MsgType = 0x02
+	MsgGetBlock  network.MsgType = 0x03
+)
+
+const (
+	MaskBit = (1 << 31) // marks response of request type
+)
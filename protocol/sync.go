@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+
+	"github.com/number571/union-bc/kernel"
+	"github.com/number571/union-bc/network"
+)
+
+// Download blocks of peer if its chain is longer.
+// Blocks after common ancestor are replaced if chains
+// are forked. Accepted blocks are kept if sync fails,
+// so next call continues from them.
+func SyncFrom(chain kernel.Chain, client network.Client) error {
+	peerHeight, err := GetHeight(client)
+	if err != nil {
+		return err
+	}
+
+	height := chain.Height()
+	if peerHeight <= height {
+		return nil
+	}
+
+	ancestor, err := findAncestor(chain, client, height)
+	if err != nil {
+		return err
+	}
+
+	// branch replaces blocks after ancestor
+	// and must be longer than them
+	if ancestor != height {
+		var branch []kernel.Block
+		for i := ancestor + 1; i <= height+1; i++ {
+			block, err := GetBlock(client, i)
+			if err != nil {
+				return err
+			}
+			branch = append(branch, block)
+		}
+
+		if !chain.TryReorg(branch) {
+			return ErrBlockRejected
+		}
+	}
+
+	for i := chain.Height() + 1; i <= peerHeight; i++ {
+		block, err := GetBlock(client, i)
+		if err != nil {
+			return err
+		}
+
+		if !chain.Accept(block) {
+			return ErrBlockRejected
+		}
+	}
+
+	return nil
+}
+
+// Walk down from height to last block equal in both chains.
+func findAncestor(chain kernel.Chain, client network.Client, height kernel.Height) (kernel.Height, error) {
+	for i := height; ; i-- {
+		local := chain.Block(i)
+		if local == nil {
+			// blocks below are pruned
+			return 0, ErrOtherChain
+		}
+
+		block, err := GetBlock(client, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if bytes.Equal(local.Hash(), block.Hash()) {
+			return i, nil
+		}
+
+		if i == 0 {
+			return 0, ErrOtherChain
+		}
+	}
+}
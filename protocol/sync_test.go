@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/number571/go-peer/crypto"
+	"github.com/number571/union-bc/kernel"
+	"github.com/number571/union-bc/network"
+)
+
+var (
+	testPriv  = crypto.NewPrivKey(kernel.KeySize)
+	testNonce = 0
+)
+
+func newTestBlock(prevHash kernel.Hash) kernel.Block {
+	txs := make([]kernel.Transaction, 0, kernel.TXsSize)
+	for i := 0; i < kernel.TXsSize; i++ {
+		testNonce++
+		txs = append(txs, kernel.NewTransaction(testPriv, []byte(fmt.Sprintf("tx-%d", testNonce))))
+	}
+	return kernel.NewBlock(prevHash, txs)
+}
+
+func newTestChain(t *testing.T, genesis kernel.Block, height int) kernel.Chain {
+	chain := kernel.NewChainWithDB(
+		kernel.NewMemoryDB(),
+		kernel.NewMemoryDB(),
+		kernel.NewMemoryDB(),
+		genesis,
+	)
+	if chain == nil {
+		t.Fatal("chain is nil")
+	}
+	t.Cleanup(chain.Close)
+
+	growTestChain(t, chain, height)
+	return chain
+}
+
+func growTestChain(t *testing.T, chain kernel.Chain, n int) {
+	for i := 0; i < n; i++ {
+		if !chain.Accept(newTestBlock(chain.Block(chain.Height()).Hash())) {
+			t.Fatalf("block %d not accepted", i+1)
+		}
+	}
+}
+
+// Node serving blocks of chain.
+func newTestPeer(t *testing.T, chain kernel.Chain) network.Client {
+	node := network.NewNode("peer").
+		Handle(MsgGetHeight, HandleGetHeight(chain)).
+		Handle(MsgGetBlock, HandleGetBlock(chain))
+	t.Cleanup(func() { node.Close() })
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Serve(listen)
+
+	client, err := network.NewClient(listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func testSynced(t *testing.T, chain, peer kernel.Chain) {
+	if chain.Height() != peer.Height() {
+		t.Fatalf("height is %d, expected %d", chain.Height(), peer.Height())
+	}
+
+	if !bytes.Equal(chain.Block(chain.Height()).Hash(), peer.Block(peer.Height()).Hash()) {
+		t.Fatal("tip is not of peer")
+	}
+
+	if height, err := chain.Verify(); err != nil {
+		t.Fatalf("chain is invalid at %d: %v", height, err)
+	}
+}
+
+func TestSyncFrom(t *testing.T) {
+	var (
+		genesis = newTestBlock([]byte(kernel.ChainID))
+		peer    = newTestChain(t, genesis, 20)
+		chain   = newTestChain(t, genesis, 0)
+	)
+
+	if !chain.Accept(peer.Block(1)) {
+		t.Fatal("block not accepted")
+	}
+
+	if err := SyncFrom(chain, newTestPeer(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+	testSynced(t, chain, peer)
+}
+
+// Sync continues from blocks accepted before.
+func TestSyncFromResume(t *testing.T) {
+	var (
+		genesis = newTestBlock([]byte(kernel.ChainID))
+		peer    = newTestChain(t, genesis, 5)
+		chain   = newTestChain(t, genesis, 0)
+		client  = newTestPeer(t, peer)
+	)
+
+	if err := SyncFrom(chain, client); err != nil {
+		t.Fatal(err)
+	}
+	testSynced(t, chain, peer)
+
+	growTestChain(t, peer, 5)
+
+	if err := SyncFrom(chain, client); err != nil {
+		t.Fatal(err)
+	}
+	testSynced(t, chain, peer)
+}
+
+func TestSyncFromFork(t *testing.T) {
+	var (
+		genesis = newTestBlock([]byte(kernel.ChainID))
+		peer    = newTestChain(t, genesis, 10)
+		chain   = newTestChain(t, genesis, 0)
+	)
+
+	// chains are forked after block 2
+	for i := kernel.Height(1); i <= 2; i++ {
+		if !chain.Accept(peer.Block(i)) {
+			t.Fatalf("block %d not accepted", i)
+		}
+	}
+	growTestChain(t, chain, 4)
+
+	if err := SyncFrom(chain, newTestPeer(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+	testSynced(t, chain, peer)
+}
+
+func TestSyncFromBehind(t *testing.T) {
+	var (
+		genesis = newTestBlock([]byte(kernel.ChainID))
+		peer    = newTestChain(t, genesis, 2)
+		chain   = newTestChain(t, genesis, 0)
+	)
+
+	for i := kernel.Height(1); i <= 2; i++ {
+		if !chain.Accept(peer.Block(i)) {
+			t.Fatalf("block %d not accepted", i)
+		}
+	}
+	growTestChain(t, chain, 2)
+	tip := chain.Block(chain.Height())
+
+	if err := SyncFrom(chain, newTestPeer(t, peer)); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain.Height() != 4 || !bytes.Equal(chain.Block(4).Hash(), tip.Hash()) {
+		t.Fatal("chain is changed by peer behind")
+	}
+}
+
+func TestSyncFromOtherChain(t *testing.T) {
+	var (
+		peer  = newTestChain(t, newTestBlock([]byte(kernel.ChainID)), 3)
+		chain = newTestChain(t, newTestBlock([]byte(kernel.ChainID)), 1)
+	)
+
+	if err := SyncFrom(chain, newTestPeer(t, peer)); err != ErrOtherChain {
+		t.Fatalf("got error %v, expected %v", err, ErrOtherChain)
+	}
+
+	if chain.Height() != 1 {
+		t.Fatalf("height is %d, expected 1", chain.Height())
+	}
+}